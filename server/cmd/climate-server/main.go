@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"climate/server/internal/app"
 	"climate/server/internal/config"
@@ -19,12 +20,35 @@ func main() {
 	}
 
 	cfg := app.Config{
-		CodexBin:   loaded.Config.CodexBin,
-		BindIP:     loaded.Config.BindIP,
-		Port:       loaded.Config.Port,
-		TSAuthKey:  loaded.Config.TSAuthKey,
-		TSHostname: loaded.Config.TSHostname,
-		TSStateDir: loaded.Config.TSStateDir,
+		CodexBin:     loaded.Config.CodexBin,
+		BindIP:       loaded.Config.BindIP,
+		Port:         loaded.Config.Port,
+		TSAuthKey:    loaded.Config.TSAuthKey,
+		TSHostname:   loaded.Config.TSHostname,
+		TSStateDir:   loaded.Config.TSStateDir,
+		StopGrace:    loaded.Config.StopGrace,
+		CgroupParent: loaded.Config.CgroupParent,
+		Policy:       loaded.Config.Policy,
+
+		WSOriginPatterns: loaded.Config.WSOriginPatterns,
+
+		MaxSessions:     loaded.Config.Session.MaxSessions,
+		IdleTTL:         loaded.Config.Session.IdleTTL,
+		RPCTimeout:      loaded.Config.Session.RPCTimeout,
+		MethodTimeouts:  loaded.Config.Session.MethodTimeouts,
+		HubCapacity:     loaded.Config.Session.HubCapacity,
+		JanitorInterval: loaded.Config.Session.JanitorInterval,
+		MaxBodyBytes:    loaded.Config.Session.MaxBodyBytes,
+		IdempotencyTTL:  loaded.Config.Session.IdempotencyTTL,
+		ElideBytes:      loaded.Config.Session.ElideBytes,
+		MaxLineBytes:    loaded.Config.Session.MaxLineBytes,
+
+		EventStoreMaxBytes:     loaded.Config.EventStore.MaxBytes,
+		EventStoreMaxAge:       loaded.Config.EventStore.MaxAge,
+		EventStoreSegmentBytes: loaded.Config.EventStore.SegmentBytes,
+	}
+	if loaded.Config.EventStore.Enabled {
+		cfg.EventStoreDir = valueOr(loaded.Config.EventStore.Dir, "~/.climate/events")
 	}
 
 	flag.StringVar(&cfg.CodexBin, "codex-bin", valueOr(cfg.CodexBin, "codex"), "Path to codex binary")
@@ -33,6 +57,18 @@ func main() {
 	flag.StringVar(&cfg.TSAuthKey, "ts-auth-key", valueOr(cfg.TSAuthKey, ""), "Tailscale auth key (tsnet)")
 	flag.StringVar(&cfg.TSHostname, "ts-hostname", valueOr(cfg.TSHostname, "climate-server"), "Tailscale hostname")
 	flag.StringVar(&cfg.TSStateDir, "ts-state-dir", cfg.TSStateDir, "State directory for tsnet (default ~/.climate/tsnet)")
+	flag.DurationVar(&cfg.StopGrace, "stop-grace", valueOrDuration(cfg.StopGrace, 5*time.Second), "Grace period per step when stopping codex (interrupt, SIGTERM, SIGKILL)")
+	flag.StringVar(&cfg.CgroupParent, "cgroup-parent", cfg.CgroupParent, "Writable cgroup v2 directory to put each codex session in (Linux only)")
+	flag.IntVar(&cfg.MaxSessions, "max-sessions", valueOrInt(cfg.MaxSessions, 16), "Maximum concurrently running codex sessions")
+	flag.DurationVar(&cfg.IdleTTL, "idle-ttl", valueOrDuration(cfg.IdleTTL, 10*time.Minute), "Stop codex sessions idle for this long (negative disables)")
+	flag.DurationVar(&cfg.RPCTimeout, "rpc-timeout", valueOrDuration(cfg.RPCTimeout, 30*time.Second), "How long /rpc waits for codex to answer (see session.method_timeouts for overrides)")
+	flag.IntVar(&cfg.HubCapacity, "hub-capacity", valueOrInt(cfg.HubCapacity, 1024), "Events retained per client for SSE replay")
+	flag.DurationVar(&cfg.JanitorInterval, "janitor-interval", valueOrDuration(cfg.JanitorInterval, 30*time.Second), "How often idle sessions are looked for")
+	flag.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", valueOrInt64(cfg.MaxBodyBytes, 10<<20), "Maximum /rpc request body size")
+	flag.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", valueOrDuration(cfg.IdempotencyTTL, 10*time.Minute), "How long /rpc responses are kept for retries with the same Idempotency-Key (negative disables)")
+	flag.IntVar(&cfg.ElideBytes, "elide-bytes", valueOrInt(cfg.ElideBytes, 256<<10), "Replace event strings larger than this with a /v1/blobs reference (negative disables)")
+	flag.IntVar(&cfg.MaxLineBytes, "max-line-bytes", valueOrInt(cfg.MaxLineBytes, 64<<20), "Drop codex output lines larger than this, failing the request they answer (negative disables)")
+	flag.StringVar(&cfg.EventStoreDir, "event-store-dir", cfg.EventStoreDir, "Persist events under this directory so SSE replay survives restarts (e.g. ~/.climate/events)")
 	flag.String("config", loaded.ConfigFile, "Path to config file (yaml)")
 	flag.Parse()
 
@@ -57,3 +93,17 @@ func valueOrInt(value, fallback int) int {
 	}
 	return value
 }
+
+func valueOrInt64(value, fallback int64) int64 {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+func valueOrDuration(value, fallback time.Duration) time.Duration {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
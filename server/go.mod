@@ -3,6 +3,7 @@ module climate/server
 go 1.25.5
 
 require (
+	github.com/coder/websocket v1.8.12
 	github.com/spf13/viper v1.18.2
 	golang.org/x/sync v0.19.0
 	tailscale.com v1.94.1
@@ -25,7 +26,6 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.28.13 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.41.5 // indirect
 	github.com/aws/smithy-go v1.24.0 // indirect
-	github.com/coder/websocket v1.8.12 // indirect
 	github.com/creachadair/msync v0.7.1 // indirect
 	github.com/dblohm7/wingoes v0.0.0-20240119213807-a09d6be7affa // indirect
 	github.com/fsnotify/fsnotify v1.9.0 // indirect
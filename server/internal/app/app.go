@@ -13,8 +13,10 @@ import (
 	"time"
 
 	"climate/server/internal/codex"
+	"climate/server/internal/events"
 	"climate/server/internal/httpx"
 	"climate/server/internal/identity"
+	"climate/server/internal/policy"
 	"climate/server/internal/tailnet"
 	"golang.org/x/sync/errgroup"
 )
@@ -26,13 +28,73 @@ type Config struct {
 	TSAuthKey  string
 	TSHostname string
 	TSStateDir string
+
+	// StopGrace is how long each step of a graceful codex shutdown
+	// (interrupt + close stdin, SIGTERM) waits before escalating.
+	StopGrace time.Duration
+	// CgroupParent, if set, is a writable cgroup v2 directory under which each
+	// codex session gets its own cgroup (Linux only).
+	CgroupParent string
+	// WSOriginPatterns are the browser origins, besides the server's own,
+	// allowed to open /ws; see httpx.Options.
+	WSOriginPatterns []string
+
+	// Session tunables; see codex.ManagerOptions. Zero values keep the defaults.
+	MaxSessions     int
+	IdleTTL         time.Duration
+	RPCTimeout      time.Duration
+	MethodTimeouts  map[string]time.Duration
+	HubCapacity     int
+	JanitorInterval time.Duration
+	MaxBodyBytes    int64
+	IdempotencyTTL  time.Duration
+	ElideBytes      int
+	MaxLineBytes    int
+
+	// EventStoreDir, if set, persists each client's events under it so SSE
+	// replay survives restarts; the other EventStore fields size it.
+	EventStoreDir          string
+	EventStoreMaxBytes     int64
+	EventStoreMaxAge       time.Duration
+	EventStoreSegmentBytes int64
+
+	Policy policy.Config
 }
 
 func Run(ctx context.Context, cfg Config) error {
 	cfg = normalizeConfig(cfg)
 
-	manager := codex.NewManager(cfg.CodexBin)
-	localHandler := httpx.NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	approvals, err := policy.New(cfg.Policy)
+	if err != nil {
+		return fmt.Errorf("invalid approval policy: %w", err)
+	}
+
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{
+		CodexBin:       cfg.CodexBin,
+		MaxSessions:    cfg.MaxSessions,
+		IdleTTL:        cfg.IdleTTL,
+		RPCTimeout:     cfg.RPCTimeout,
+		MethodTimeouts: cfg.MethodTimeouts,
+		HubCapacity:    cfg.HubCapacity,
+		ElideBytes:     cfg.ElideBytes,
+		MaxLineBytes:   cfg.MaxLineBytes,
+		EventStoreDir:  cfg.EventStoreDir,
+		EventStore: events.StoreConfig{
+			MaxBytes:     cfg.EventStoreMaxBytes,
+			MaxAge:       cfg.EventStoreMaxAge,
+			SegmentBytes: cfg.EventStoreSegmentBytes,
+		},
+		JanitorInterval: cfg.JanitorInterval,
+		StopGrace:       cfg.StopGrace,
+		CgroupParent:    cfg.CgroupParent,
+		Policy:          approvals,
+	})
+	httpOpts := httpx.Options{
+		MaxBodyBytes:     cfg.MaxBodyBytes,
+		IdempotencyTTL:   cfg.IdempotencyTTL,
+		WSOriginPatterns: cfg.WSOriginPatterns,
+	}
+	localHandler := httpx.NewHandlerWithOptions(manager, identity.Header{HeaderName: "X-Client-ID"}, httpOpts)
 
 	localAddr := fmt.Sprintf("%s:%d", cfg.BindIP, cfg.Port)
 	localBase := fmt.Sprintf("http://%s", localAddr)
@@ -67,6 +129,12 @@ func Run(ctx context.Context, cfg Config) error {
 	} else {
 		log.Printf("- publish: local only (tsnet disabled)")
 	}
+	if cfg.EventStoreDir != "" {
+		log.Printf("- event store: %s", cfg.EventStoreDir)
+	}
+	if n := len(cfg.Policy.Rules); n > 0 {
+		log.Printf("- approval policy: %d rule(s)", n)
+	}
 	log.Printf("Press Ctrl+C to stop.")
 
 	localServer := &http.Server{Handler: localHandler}
@@ -82,7 +150,7 @@ func Run(ctx context.Context, cfg Config) error {
 			log.Printf("[warn] tsnet LocalClient unavailable; falling back to header identity")
 			tailIdentity = identity.Header{HeaderName: "X-Client-ID"}
 		}
-		tailHandler := httpx.NewHandler(manager, tailIdentity)
+		tailHandler := httpx.NewHandlerWithOptions(manager, tailIdentity, httpOpts)
 		tailServer = &http.Server{Handler: tailHandler}
 		group.Go(func() error {
 			return serveHTTP(tailServer, tail.Listener)
@@ -102,7 +170,16 @@ func Run(ctx context.Context, cfg Config) error {
 		}
 	}()
 
-	return group.Wait()
+	err = group.Wait()
+
+	// Servers are down; stop codex sessions without leaving half-applied
+	// patches or orphaned tool processes behind.
+	closeCtx, cancel := context.WithTimeout(context.Background(), 2*cfg.StopGrace+5*time.Second)
+	defer cancel()
+	if closeErr := manager.Close(closeCtx); closeErr != nil {
+		log.Printf("[warn] codex sessions did not stop in time: %v", closeErr)
+	}
+	return err
 }
 
 func serveHTTP(server *http.Server, listener net.Listener) error {
@@ -131,6 +208,10 @@ func normalizeConfig(cfg Config) Config {
 		cfg.TSStateDir = defaultStateDir()
 	}
 	cfg.TSStateDir = expandHomeDir(cfg.TSStateDir)
+	cfg.EventStoreDir = expandHomeDir(cfg.EventStoreDir)
+	if cfg.StopGrace <= 0 {
+		cfg.StopGrace = 5 * time.Second
+	}
 	return cfg
 }
 
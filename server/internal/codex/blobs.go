@@ -0,0 +1,144 @@
+package codex
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultElideBytes = 256 << 10
+	// maxBlobBytes caps the elided content kept per client; the oldest
+	// blobs are dropped first.
+	maxBlobBytes = 64 << 20
+)
+
+// elidedRef replaces a large string field in an event. The full string is
+// served by GET /v1/blobs/{ref}.
+type elidedRef struct {
+	Elided bool   `json:"elided"`
+	Bytes  int    `json:"bytes"`
+	Ref    string `json:"ref"`
+}
+
+type blob struct {
+	data    []byte
+	created time.Time
+}
+
+// blobStore holds elided strings by content hash, so repeated payloads
+// (e.g. successive thread/read results) share one blob.
+type blobStore struct {
+	mu    sync.Mutex
+	blobs map[string]blob
+	order []string
+	size  int
+}
+
+func (b *blobStore) put(data []byte) string {
+	sum := sha256.Sum256(data)
+	ref := hex.EncodeToString(sum[:])
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.blobs == nil {
+		b.blobs = make(map[string]blob)
+	}
+	if _, ok := b.blobs[ref]; ok {
+		return ref
+	}
+	for b.size+len(data) > maxBlobBytes && len(b.order) > 0 {
+		oldest := b.order[0]
+		b.order = b.order[1:]
+		b.size -= len(b.blobs[oldest].data)
+		delete(b.blobs, oldest)
+	}
+	b.blobs[ref] = blob{data: data, created: time.Now()}
+	b.order = append(b.order, ref)
+	b.size += len(data)
+	return ref
+}
+
+func (b *blobStore) get(ref string) (blob, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	blob, ok := b.blobs[ref]
+	return blob, ok
+}
+
+// elide returns line with every JSON string longer than threshold bytes
+// replaced by an elidedRef, storing the strings in blobs. It returns nil when
+// nothing was replaced: for lines no longer than threshold, or not JSON.
+func elide(line []byte, threshold int, blobs *blobStore) []byte {
+	if threshold <= 0 || blobs == nil || len(line) <= threshold {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil
+	}
+	value, changed := elideValue(value, threshold, blobs)
+	if !changed {
+		return nil
+	}
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
+
+func elideValue(value any, threshold int, blobs *blobStore) (any, bool) {
+	switch v := value.(type) {
+	case string:
+		if len(v) <= threshold {
+			return v, false
+		}
+		return elidedRef{Elided: true, Bytes: len(v), Ref: blobs.put([]byte(v))}, true
+	case map[string]any:
+		changed := false
+		for key, field := range v {
+			if replaced, ok := elideValue(field, threshold, blobs); ok {
+				v[key] = replaced
+				changed = true
+			}
+		}
+		return v, changed
+	case []any:
+		changed := false
+		for i, field := range v {
+			if replaced, ok := elideValue(field, threshold, blobs); ok {
+				v[i] = replaced
+				changed = true
+			}
+		}
+		return v, changed
+	}
+	return value, false
+}
+
+// elide applies the manager's elision threshold to an event payload, for
+// Event.Elided; nil means there is nothing to elide.
+func (s *Session) elide(line []byte) []byte {
+	return elide(line, s.elideBytes, s.blobs)
+}
+
+// Blob returns content elided from one of the client's events.
+func (m *Manager) Blob(clientKey, ref string) ([]byte, time.Time, bool) {
+	m.mu.Lock()
+	entry := m.sessions[strings.TrimSpace(clientKey)]
+	m.mu.Unlock()
+	if entry == nil {
+		return nil, time.Time{}, false
+	}
+	blob, ok := entry.blobs.get(ref)
+	return blob.data, blob.created, ok
+}
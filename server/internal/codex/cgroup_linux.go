@@ -0,0 +1,81 @@
+//go:build linux
+
+package codex
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cgroup is a cgroup v2 directory holding one codex process tree. Unlike the
+// process group it also catches descendants that called setsid/setpgid.
+type cgroup struct {
+	path string
+}
+
+func newCgroup(parent string, name string) (*cgroup, error) {
+	path := filepath.Join(parent, name)
+	if err := os.Mkdir(path, 0o755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("create cgroup %s: %w", path, err)
+	}
+	return &cgroup{path: path}, nil
+}
+
+// place makes cmd start inside the cgroup (clone3 with CLONE_INTO_CGROUP,
+// Linux 5.7+). The returned func closes the cgroup's fd once cmd has
+// started.
+func (c *cgroup) place(cmd *exec.Cmd) (func(), error) {
+	dir, err := os.Open(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("open cgroup %s: %w", c.path, err)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return func() { _ = dir.Close() }, nil
+}
+
+// holds reports whether pid is in the cgroup.
+func (c *cgroup) holds(pid int) bool {
+	return slices.Contains(c.members(), pid)
+}
+
+func (c *cgroup) add(pid int) error {
+	return os.WriteFile(filepath.Join(c.path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0o644)
+}
+
+func (c *cgroup) members() []int {
+	data, err := os.ReadFile(filepath.Join(c.path, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	var out []int
+	for _, line := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(line); err == nil {
+			out = append(out, pid)
+		}
+	}
+	return out
+}
+
+// kill uses cgroup.kill (Linux 5.14+) and falls back to signalling members.
+func (c *cgroup) kill() {
+	if err := os.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0o644); err == nil {
+		return
+	}
+	for _, pid := range c.members() {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+func (c *cgroup) remove() {
+	_ = os.Remove(c.path)
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package codex
+
+import (
+	"errors"
+	"os/exec"
+)
+
+type cgroup struct{}
+
+func newCgroup(string, string) (*cgroup, error) {
+	return nil, errors.New("cgroups are only supported on Linux")
+}
+
+func (c *cgroup) place(*exec.Cmd) (func(), error) {
+	return nil, errors.New("cgroups are only supported on Linux")
+}
+
+func (c *cgroup) holds(int) bool { return false }
+
+func (c *cgroup) add(int) error { return nil }
+
+func (c *cgroup) members() []int { return nil }
+
+func (c *cgroup) kill() {}
+
+func (c *cgroup) remove() {}
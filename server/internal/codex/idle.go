@@ -0,0 +1,125 @@
+package codex
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// MaxLease bounds how long a client can keep its session from being reaped.
+const MaxLease = 24 * time.Hour
+
+var ErrInvalidLease = errors.New("lease duration must be between 0 and 24h")
+
+// Lease keeps clientKey's session from being reaped as idle for d, e.g. while
+// an overnight job runs with nobody watching. A zero d releases the lease.
+// It returns the time the lease will end.
+func (m *Manager) Lease(clientKey string, d time.Duration) (time.Time, error) {
+	clientKey = strings.TrimSpace(clientKey)
+	if clientKey == "" {
+		return time.Time{}, errors.New("missing client key")
+	}
+	if d < 0 || d > MaxLease {
+		return time.Time{}, ErrInvalidLease
+	}
+
+	entry := m.getOrCreate(clientKey)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	entry.leaseUntil = time.Time{}
+	payload := map[string]any{"durationMs": d.Milliseconds()}
+	if d > 0 {
+		entry.leaseUntil = time.Now().Add(d)
+		payload["until"] = entry.leaseUntil
+	}
+	publishJSON(entry.hub, "session/lease", payload)
+	return entry.leaseUntil, nil
+}
+
+func (m *Manager) startJanitor() {
+	m.janitorOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(m.janitorInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-m.stopJanitor:
+					return
+				case <-ticker.C:
+					m.sweepIdle()
+				}
+			}
+		}()
+	})
+}
+
+// sweepIdle stops sessions that have neither work in flight nor anyone
+// watching and have been quiet for the idle TTL.
+func (m *Manager) sweepIdle() {
+	ttl := m.idleTTL
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+
+	grace := m.stopGrace
+	m.mu.Lock()
+	entries := make([]*clientEntry, 0, len(m.sessions))
+	for _, entry := range m.sessions {
+		entries = append(entries, entry)
+	}
+	m.mu.Unlock()
+
+	for _, entry := range entries {
+		entry.mu.Lock()
+		s := entry.session
+		leased := entry.leaseUntil.After(now)
+		entry.mu.Unlock()
+		if s == nil || s.Dead() {
+			continue
+		}
+		if leased || s.busy() || entry.hub.Subscribers() > 0 {
+			// Restart the idle clock so it counts from when the session
+			// stopped being busy rather than from its last traffic.
+			s.touch()
+			continue
+		}
+		last := s.LastActivity()
+		if last.IsZero() {
+			continue
+		}
+		if now.Sub(last) < ttl {
+			continue
+		}
+
+		entry.mu.Lock()
+		if entry.session == s && !s.Dead() {
+			publishJSON(entry.hub, "session/idle-killed", map[string]any{
+				"idleMs": now.Sub(last).Milliseconds(),
+			})
+			entry.session = nil
+			go func() {
+				_ = s.stop(context.Background(), grace, exitIdle)
+			}()
+		}
+		entry.mu.Unlock()
+	}
+}
+
+// busy reports whether the session has a turn running, an approval waiting
+// for an answer or a client RPC in flight.
+func (s *Session) busy() bool {
+	if s.turns.count() > 0 {
+		return true
+	}
+	s.serverReqMu.Lock()
+	waiting := len(s.serverRequests)
+	s.serverReqMu.Unlock()
+	if waiting > 0 {
+		return true
+	}
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return len(s.pending) > 0
+}
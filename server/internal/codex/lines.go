@@ -0,0 +1,130 @@
+package codex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+const (
+	defaultMaxLineBytes = 64 << 20
+	// lineHeadBytes is how much of an oversized line is kept to find out
+	// what it was.
+	lineHeadBytes = 4 << 10
+	stdoutBuffer  = 64 << 10
+)
+
+// ErrResponseTooLarge fails a request whose response line exceeded the
+// session's line limit.
+var ErrResponseTooLarge = errors.New("codex response exceeds the bridge's line limit")
+
+// readLine reads one newline-terminated line of any length, without the
+// line terminator. If the line is longer than limit (when limit > 0) it is
+// consumed and discarded: only its first lineHeadBytes are returned, with
+// tooLong set. size is the full length of the line.
+func readLine(r *bufio.Reader, limit int) (line []byte, size int, tooLong bool, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		size += len(chunk)
+		switch {
+		case !tooLong && (limit <= 0 || size <= limit || size == limit+1 && chunk[len(chunk)-1] == '\n'):
+			line = append(line, chunk...)
+		case !tooLong:
+			tooLong = true
+			line = line[:min(len(line), lineHeadBytes)]
+			fallthrough
+		default:
+			if room := lineHeadBytes - len(line); room > 0 {
+				line = append(line, chunk[:min(room, len(chunk))]...)
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil && (size == 0 || !errors.Is(err, io.EOF)) {
+			return nil, 0, false, err
+		}
+		if n := len(chunk); n > 0 && chunk[n-1] == '\n' {
+			size--
+			if !tooLong {
+				line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+			}
+		}
+		return line, size, tooLong, nil
+	}
+}
+
+// handleOversizedLine deals with a stdout line over the limit instead of
+// stalling the reader: a response fails the request waiting for it, a
+// codex-initiated request is answered with an error, and clients get a
+// session/error event either way.
+func (s *Session) handleOversizedLine(head []byte, size int) {
+	rawID, method := sniffMessage(head)
+	info := map[string]any{
+		"reason": "line_too_long",
+		"bytes":  size,
+		"limit":  s.maxLineBytes,
+	}
+	if method != "" {
+		info["method"] = method
+	}
+
+	msg := rpcMessage{ID: rawID, Method: method}
+	idKey, hasID := msg.idKey()
+	switch {
+	case hasID && method == "":
+		s.pendingMu.Lock()
+		call := s.pending[idKey]
+		delete(s.pending, idKey)
+		s.pendingMu.Unlock()
+		if call != nil {
+			info["method"] = call.method
+			call.err = fmt.Errorf("%w (%d bytes, limit %d)", ErrResponseTooLarge, size, s.maxLineBytes)
+			close(call.ch)
+		}
+	case hasID:
+		reply, _ := json.Marshal(rpcMessage{
+			ID:    rawID,
+			Error: json.RawMessage(`{"code":-32603,"message":"request too large for the bridge"}`),
+		})
+		if err := s.writeLine(reply); err != nil {
+			log.Printf("[codex] client=%s failed to reject oversized request: %v", s.clientKey, err)
+		}
+	}
+	log.Printf("[codex] client=%s dropped %d-byte stdout line (limit %d, method=%q)", s.clientKey, size, s.maxLineBytes, info["method"])
+	publishJSON(s.events, "session/error", info)
+}
+
+// sniffMessage reads the id and method from the start of a JSON-RPC
+// message, as far as the (possibly truncated) input allows. codex writes
+// them ahead of params and result.
+func sniffMessage(head []byte) (json.RawMessage, string) {
+	decoder := json.NewDecoder(bytes.NewReader(head))
+	if tok, err := decoder.Token(); err != nil || tok != json.Delim('{') {
+		return nil, ""
+	}
+	var id json.RawMessage
+	var method string
+	for decoder.More() {
+		tok, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			break
+		}
+		switch key {
+		case "id":
+			id = value
+		case "method":
+			_ = json.Unmarshal(value, &method)
+		}
+	}
+	return id, method
+}
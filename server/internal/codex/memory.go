@@ -0,0 +1,174 @@
+package codex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	restoreTimeout = 30 * time.Second
+	// maxRememberedThreads bounds the threads resumed after a respawn; the
+	// least recently loaded are forgotten first.
+	maxRememberedThreads = 64
+)
+
+// sessionMemory is what a client entry remembers about its codex process:
+// the client's initialize params and the threads it had loaded.
+type sessionMemory struct {
+	mu               sync.Mutex
+	initializeParams json.RawMessage
+	initializedSent  bool
+	threads          []string
+}
+
+func (m *sessionMemory) observeRequest(method string, params any) {
+	switch method {
+	case "initialize":
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		m.initializeParams = raw
+		m.mu.Unlock()
+	case "initialized":
+		m.mu.Lock()
+		m.initializedSent = true
+		m.mu.Unlock()
+	}
+}
+
+// observeResponse records thread ids loaded by a successful thread/start,
+// thread/resume or thread/fork.
+func (m *sessionMemory) observeResponse(method string, resp []byte) {
+	switch method {
+	case "thread/start", "thread/resume", "thread/fork":
+	default:
+		return
+	}
+	var decoded struct {
+		Result struct {
+			Thread struct {
+				ID string `json:"id"`
+			} `json:"thread"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(resp, &decoded); err != nil {
+		return
+	}
+	m.addThread(decoded.Result.Thread.ID)
+}
+
+func (m *sessionMemory) observeNotification(msg rpcMessage) {
+	if msg.Method != "thread/started" {
+		return
+	}
+	var params struct {
+		Thread struct {
+			ID string `json:"id"`
+		} `json:"thread"`
+	}
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return
+	}
+	m.addThread(params.Thread.ID)
+}
+
+func (m *sessionMemory) addThread(id string) {
+	if id == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.threads = slices.DeleteFunc(m.threads, func(existing string) bool { return existing == id })
+	m.threads = append(m.threads, id)
+	if over := len(m.threads) - maxRememberedThreads; over > 0 {
+		m.threads = slices.Delete(m.threads, 0, over)
+	}
+}
+
+func (m *sessionMemory) snapshot() (json.RawMessage, bool, []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.initializeParams, m.initializedSent, append([]string(nil), m.threads...)
+}
+
+type restoreFailure struct {
+	ThreadID string `json:"threadId,omitempty"`
+	Method   string `json:"method"`
+	Error    string `json:"error"`
+}
+
+// restore replays initialize/initialized and thread/resume for every thread
+// the client had loaded, then publishes `session/respawned`.
+func (s *Session) restore(memory *sessionMemory) {
+	initParams, initializedSent, threads := memory.snapshot()
+	if len(initParams) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), restoreTimeout)
+	defer cancel()
+
+	var failures []restoreFailure
+	resumed := make([]string, 0, len(threads))
+
+	initialized := false
+	if err := s.call(ctx, "initialize", initParams); err != nil {
+		failures = append(failures, restoreFailure{Method: "initialize", Error: err.Error()})
+	} else {
+		initialized = true
+		if initializedSent {
+			if _, err := s.send(ctx, map[string]any{"method": "initialized"}, true); err != nil {
+				failures = append(failures, restoreFailure{Method: "initialized", Error: err.Error()})
+			}
+		}
+	}
+
+	if initialized {
+		for _, threadID := range threads {
+			params := map[string]any{"threadId": threadID}
+			if err := s.call(ctx, "thread/resume", params); err != nil {
+				failures = append(failures, restoreFailure{ThreadID: threadID, Method: "thread/resume", Error: err.Error()})
+				continue
+			}
+			resumed = append(resumed, threadID)
+		}
+	}
+
+	log.Printf("[codex] client=%s respawned: resumed %d/%d thread(s)", s.clientKey, len(resumed), len(threads))
+	publishJSON(s.events, "session/respawned", map[string]any{
+		"initialized": initialized,
+		"threads":     resumed,
+		"failures":    failures,
+	})
+}
+
+// call issues an internal request and turns a JSON-RPC error into a Go error.
+func (s *Session) call(ctx context.Context, method string, params any) error {
+	resp, err := s.send(ctx, map[string]any{
+		"method": method,
+		"id":     "climate-" + method,
+		"params": params,
+	}, true)
+	if err != nil {
+		return err
+	}
+	var decoded struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(resp, &decoded); err != nil {
+		return fmt.Errorf("invalid %s response: %w", method, err)
+	}
+	if decoded.Error != nil {
+		return fmt.Errorf("%s failed: %s", method, decoded.Error.Message)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package codex
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// rpcMessage is the JSON-RPC envelope shared by requests, notifications and
+// responses on the app-server stdio transport (the "jsonrpc" field is omitted
+// on the wire).
+type rpcMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+// pendingCall is a client request forwarded upstream under a bridge-owned id.
+type pendingCall struct {
+	clientID json.RawMessage
+	method   string
+	params   any
+	ch       chan []byte
+	internal bool
+	// err, if set before ch is closed, is why the call failed.
+	err error
+}
+
+func decodeMessage(line []byte) (rpcMessage, error) {
+	var msg rpcMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return rpcMessage{}, err
+	}
+	return msg, nil
+}
+
+func (m rpcMessage) hasID() bool {
+	id := bytes.TrimSpace(m.ID)
+	return len(id) > 0 && !bytes.Equal(id, []byte("null"))
+}
+
+// isRequest reports whether the message expects a response. Requests coming
+// from codex are told apart from responses by the presence of `method`.
+func (m rpcMessage) isRequest() bool {
+	return m.Method != "" && m.hasID()
+}
+
+func (m rpcMessage) isResponse() bool {
+	return m.Method == "" && m.hasID()
+}
+
+func (m rpcMessage) idKey() (string, bool) {
+	if !m.hasID() {
+		return "", false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(m.ID))
+	decoder.UseNumber()
+	var id any
+	if err := decoder.Decode(&id); err != nil {
+		return "", false
+	}
+	return jsonIDKey(id)
+}
+
+// replaceID rewrites the top-level `id` of a JSON-RPC line, leaving every
+// other byte intact: the new id is spliced in where the old one was.
+func replaceID(line []byte, id json.RawMessage) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	if tok, err := decoder.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, errors.New("not a JSON object")
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		if key != "id" {
+			continue
+		}
+		// value holds the id's bytes verbatim and ends at the offset.
+		end := int(decoder.InputOffset())
+		start := end - len(value)
+		out := make([]byte, 0, len(line)-len(value)+len(id))
+		out = append(out, line[:start]...)
+		out = append(out, id...)
+		return append(out, line[end:]...), nil
+	}
+	return nil, errors.New("no id")
+}
+
+// messageScope holds the fields codex uses to say which thread and item a
+// message is about: `threadId` on most v2 messages, `thread.id` on
+// `thread/started` and thread/* results, and `itemId` on deltas or `item.id`
+// on item/started and item/completed.
+type messageScope struct {
+	ThreadID string `json:"threadId"`
+	Thread   struct {
+		ID string `json:"id"`
+	} `json:"thread"`
+	ItemID string `json:"itemId"`
+	Item   struct {
+		ID string `json:"id"`
+	} `json:"item"`
+}
+
+func (s messageScope) threadID() string {
+	if s.ThreadID != "" {
+		return s.ThreadID
+	}
+	return s.Thread.ID
+}
+
+func (s messageScope) itemID() string {
+	if s.ItemID != "" {
+		return s.ItemID
+	}
+	return s.Item.ID
+}
+
+// scope returns the thread and item a notification or server request
+// belongs to; either is "" if it is not scoped to one.
+func (m rpcMessage) scope() messageScope {
+	var scope messageScope
+	if len(m.Params) == 0 || json.Unmarshal(m.Params, &scope) != nil {
+		return messageScope{}
+	}
+	return scope
+}
+
+// responseThreadID returns the thread a response belongs to: the one named
+// in the request, or else the one the result describes (thread/start).
+func responseThreadID(call *pendingCall, msg rpcMessage) string {
+	if params, ok := call.params.(map[string]any); ok {
+		if id, _ := params["threadId"].(string); id != "" {
+			return id
+		}
+	}
+	var scope messageScope
+	if len(msg.Result) == 0 || json.Unmarshal(msg.Result, &scope) != nil {
+		return ""
+	}
+	return scope.threadID()
+}
@@ -0,0 +1,199 @@
+package codex
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+
+	"climate/server/internal/policy"
+)
+
+var approvalKinds = map[string]string{
+	"item/commandExecution/requestApproval": policy.KindCommand,
+	"item/fileChange/requestApproval":       policy.KindFileChange,
+}
+
+// approvalFields are the parts of an approval request (or of the item it
+// refers to) that policy rules can match on.
+type approvalFields struct {
+	ThreadID       string            `json:"threadId"`
+	TurnID         string            `json:"turnId"`
+	ItemID         string            `json:"itemId"`
+	Cwd            string            `json:"cwd"`
+	Command        json.RawMessage   `json:"command"`
+	ParsedCmd      []parsedCommand   `json:"parsedCmd"`
+	CommandActions []parsedCommand   `json:"commandActions"`
+	Changes        []fileChangeEntry `json:"changes"`
+}
+
+type parsedCommand struct {
+	Cmd string `json:"cmd"`
+}
+
+type fileChangeEntry struct {
+	Path string `json:"path"`
+}
+
+// commands returns the parsed commands. The raw `command` is not split into
+// commands here: parsedCmd is only codex's reading of it, so rules accept on
+// the parsed form and check the raw line separately (see policy.Request).
+func (f approvalFields) commands() []string {
+	var out []string
+	for _, list := range [][]parsedCommand{f.ParsedCmd, f.CommandActions} {
+		for _, parsed := range list {
+			if cmd := strings.TrimSpace(parsed.Cmd); cmd != "" {
+				out = append(out, cmd)
+			}
+		}
+		if len(out) > 0 {
+			return out
+		}
+	}
+	return out
+}
+
+func (f approvalFields) paths() []string {
+	out := make([]string, 0, len(f.Changes))
+	for _, change := range f.Changes {
+		if path := strings.TrimSpace(change.Path); path != "" {
+			out = append(out, path)
+		}
+	}
+	return out
+}
+
+// commandString accepts both the string and argv forms of `command`.
+func commandString(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return strings.TrimSpace(s)
+	}
+	var argv []string
+	if json.Unmarshal(raw, &argv) == nil {
+		return strings.TrimSpace(strings.Join(argv, " "))
+	}
+	return ""
+}
+
+// itemCache remembers command and file-change items between `item/started`
+// and `item/completed`, since approval requests only reference them by id.
+type itemCache struct {
+	mu    sync.Mutex
+	items map[string]approvalFields
+}
+
+type itemNotification struct {
+	Item struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		approvalFields
+	} `json:"item"`
+}
+
+func (c *itemCache) observe(msg rpcMessage) {
+	if msg.Method != "item/started" && msg.Method != "item/completed" {
+		return
+	}
+	var note itemNotification
+	if err := json.Unmarshal(msg.Params, &note); err != nil || note.Item.ID == "" {
+		return
+	}
+	if note.Item.Type != "commandExecution" && note.Item.Type != "fileChange" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if msg.Method == "item/completed" {
+		delete(c.items, note.Item.ID)
+		return
+	}
+	if c.items == nil {
+		c.items = make(map[string]approvalFields)
+	}
+	c.items[note.Item.ID] = note.Item.approvalFields
+}
+
+func (c *itemCache) get(id string) (approvalFields, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[id]
+	return item, ok
+}
+
+// applyPolicy answers an approval request on codex's stdin when a policy rule
+// matches it, and reports whether it did so.
+func (s *Session) applyPolicy(msg rpcMessage) bool {
+	kind, ok := approvalKinds[msg.Method]
+	if !ok || s.policy == nil {
+		return false
+	}
+	var fields approvalFields
+	if err := json.Unmarshal(msg.Params, &fields); err != nil {
+		return false
+	}
+
+	req := policy.Request{
+		Kind:      kind,
+		ClientKey: s.clientKey,
+		ThreadID:  fields.ThreadID,
+		Cwd:       fields.Cwd,
+		Commands:  fields.commands(),
+		Command:   commandString(fields.Command),
+		Paths:     fields.paths(),
+	}
+	if item, ok := s.items.get(fields.ItemID); ok {
+		if req.Cwd == "" {
+			req.Cwd = item.Cwd
+		}
+		if len(req.Commands) == 0 {
+			req.Commands = item.commands()
+		}
+		if req.Command == "" {
+			req.Command = commandString(item.Command)
+		}
+		if len(req.Paths) == 0 {
+			req.Paths = item.paths()
+		}
+	}
+
+	decision, ok := s.policy.Evaluate(req)
+	if !ok {
+		return false
+	}
+
+	result, err := json.Marshal(map[string]string{"decision": decision.Decision})
+	if err != nil {
+		return false
+	}
+	line, err := json.Marshal(rpcMessage{ID: msg.ID, Result: result})
+	if err != nil {
+		return false
+	}
+	if err := s.writeLine(line); err != nil {
+		// Leave it to the client rather than hang the turn.
+		log.Printf("[policy] failed to answer %s: %v", msg.Method, err)
+		return false
+	}
+	log.Printf("[policy] client=%s method=%s decision=%s rule=%s", s.clientKey, msg.Method, decision.Decision, decision.Rule)
+
+	publishThreadJSON(s.events, "policy/decision", fields.ThreadID, map[string]any{
+		"id":       msg.ID,
+		"method":   msg.Method,
+		"threadId": fields.ThreadID,
+		"turnId":   fields.TurnID,
+		"itemId":   fields.ItemID,
+		"decision": decision.Decision,
+		"rule":     decision.Rule,
+		"reason":   decision.Reason,
+		"cwd":      req.Cwd,
+		"command":  req.Command,
+		"commands": req.Commands,
+		"paths":    req.Paths,
+	})
+	return true
+}
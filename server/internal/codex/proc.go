@@ -0,0 +1,66 @@
+package codex
+
+import (
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const reapTimeout = time.Second
+
+func (s *Session) pid() int {
+	if s.cmd == nil || s.cmd.Process == nil {
+		return 0
+	}
+	return s.cmd.Process.Pid
+}
+
+// signalTree signals the whole codex process tree: its process group and,
+// when configured, its cgroup.
+func (s *Session) signalTree(sig syscall.Signal) error {
+	err := signalGroup(s.pid(), sig)
+	if sig == syscall.SIGKILL && s.cgroup != nil {
+		s.cgroup.kill()
+	}
+	if errors.Is(err, os.ErrProcessDone) {
+		return nil
+	}
+	return err
+}
+
+// descendants lists processes still alive in the codex process group or cgroup.
+func (s *Session) descendants() []int {
+	pids := groupMembers(s.pid())
+	if s.cgroup != nil {
+		for _, pid := range s.cgroup.members() {
+			if !slices.Contains(pids, pid) {
+				pids = append(pids, pid)
+			}
+		}
+	}
+	slices.Sort(pids)
+	return pids
+}
+
+// reapDescendants kills whatever is left of the process tree once the
+// app-server itself has exited, and returns the pids that survived anyway.
+func (s *Session) reapDescendants() []int {
+	left := s.descendants()
+	if len(left) > 0 {
+		_ = s.signalTree(syscall.SIGKILL)
+		deadline := time.Now().Add(reapTimeout)
+		for len(left) > 0 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+			left = s.descendants()
+		}
+	}
+	if len(left) > 0 {
+		log.Printf("[codex] client=%s processes survived app-server pid=%d: %v", s.clientKey, s.pid(), left)
+	} else if s.cgroup != nil {
+		s.cgroup.remove()
+	}
+	return left
+}
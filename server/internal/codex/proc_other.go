@@ -0,0 +1,30 @@
+//go:build !unix
+
+package codex
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func configureProcessGroup(*exec.Cmd) {}
+
+// signalGroup can only reach the direct child on this platform.
+func signalGroup(pid int, sig syscall.Signal) error {
+	if pid <= 0 {
+		return os.ErrProcessDone
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if sig == syscall.SIGKILL {
+		return proc.Kill()
+	}
+	return proc.Signal(sig)
+}
+
+func groupMembers(int) []int {
+	return nil
+}
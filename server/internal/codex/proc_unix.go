@@ -0,0 +1,93 @@
+//go:build unix
+
+package codex
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// configureProcessGroup starts codex as the leader of its own process group,
+// so shells, test runners and dev servers it launches can be signalled with it.
+func configureProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalGroup delivers sig to every process in the group led by pgid.
+func signalGroup(pgid int, sig syscall.Signal) error {
+	if pgid <= 0 {
+		return os.ErrProcessDone
+	}
+	err := syscall.Kill(-pgid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return os.ErrProcessDone
+	}
+	return err
+}
+
+// groupMembers lists the live processes in process group pgid.
+func groupMembers(pgid int) []int {
+	if pgid <= 0 {
+		return nil
+	}
+	if err := syscall.Kill(-pgid, 0); errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	if members, ok := procGroupMembers(pgid); ok {
+		return members
+	}
+	return psGroupMembers(pgid)
+}
+
+// procGroupMembers scans /proc (Linux).
+func procGroupMembers(pgid int) ([]int, bool) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil || len(stats) == 0 {
+		return nil, false
+	}
+	var out []int
+	for _, path := range stats {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		// Fields after the parenthesised comm: state ppid pgrp ...
+		stat := string(data)
+		end := strings.LastIndexByte(stat, ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(stat[end+1:])
+		if len(fields) < 3 || fields[2] != strconv.Itoa(pgid) || fields[0] == "Z" {
+			continue
+		}
+		if pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path))); err == nil {
+			out = append(out, pid)
+		}
+	}
+	return out, true
+}
+
+// psGroupMembers falls back to ps(1) where there is no /proc (macOS).
+func psGroupMembers(pgid int) []int {
+	out, err := exec.Command("ps", "-A", "-o", "pid=,pgid=,stat=").Output()
+	if err != nil {
+		return nil
+	}
+	var members []int
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != strconv.Itoa(pgid) || strings.HasPrefix(fields[2], "Z") {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[0]); err == nil {
+			members = append(members, pid)
+		}
+	}
+	return members
+}
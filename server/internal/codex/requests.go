@@ -0,0 +1,133 @@
+package codex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrRequestNotFound = errors.New("no pending server request with that id")
+
+// ServerRequest is a codex-initiated request (command/file-change approval,
+// tool/requestUserInput, ...) that is still waiting for a client response.
+type ServerRequest struct {
+	ID         string          `json:"id"`
+	Method     string          `json:"method"`
+	Params     json.RawMessage `json:"params,omitempty"`
+	ThreadID   string          `json:"threadId,omitempty"`
+	TurnID     string          `json:"turnId,omitempty"`
+	ItemID     string          `json:"itemId,omitempty"`
+	EventID    uint64          `json:"eventId"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+
+	rawID json.RawMessage
+}
+
+type requestScope struct {
+	ThreadID string `json:"threadId"`
+	TurnID   string `json:"turnId"`
+	ItemID   string `json:"itemId"`
+}
+
+func (s *Session) trackServerRequest(msg rpcMessage, eventID uint64) {
+	idKey, ok := msg.idKey()
+	if !ok {
+		return
+	}
+	req := &ServerRequest{
+		ID:         idKey,
+		Method:     msg.Method,
+		Params:     msg.Params,
+		EventID:    eventID,
+		ReceivedAt: time.Now(),
+		rawID:      msg.ID,
+	}
+	var scope requestScope
+	if len(msg.Params) > 0 && json.Unmarshal(msg.Params, &scope) == nil {
+		req.ThreadID = scope.ThreadID
+		req.TurnID = scope.TurnID
+		req.ItemID = scope.ItemID
+	}
+
+	s.serverReqMu.Lock()
+	s.serverRequests[idKey] = req
+	s.serverReqMu.Unlock()
+}
+
+// PendingRequests returns the outstanding server requests in arrival order.
+func (s *Session) PendingRequests() []ServerRequest {
+	s.serverReqMu.Lock()
+	defer s.serverReqMu.Unlock()
+
+	out := make([]ServerRequest, 0, len(s.serverRequests))
+	for _, req := range s.serverRequests {
+		out = append(out, *req)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].EventID < out[j].EventID })
+	return out
+}
+
+// Respond answers a pending server request with either a result or an error
+// object and marks it resolved. The request is claimed before the answer is
+// written, so concurrent answers for one id reach codex once.
+func (s *Session) Respond(id string, result, rpcErr json.RawMessage) error {
+	if s.Dead() {
+		return ErrCodexNotRunning
+	}
+
+	req := s.claimServerRequest(id)
+	if req == nil {
+		return ErrRequestNotFound
+	}
+
+	reply := rpcMessage{ID: req.rawID}
+	if len(rpcErr) > 0 {
+		reply.Error = rpcErr
+	} else {
+		if len(result) == 0 {
+			result = json.RawMessage(`{}`)
+		}
+		reply.Result = result
+	}
+	line, err := json.Marshal(reply)
+	if err != nil {
+		s.unclaimServerRequest(req)
+		return fmt.Errorf("failed to serialize rpc response: %w", err)
+	}
+	if err := s.writeLine(line); err != nil {
+		s.unclaimServerRequest(req)
+		return err
+	}
+	s.publishResolved(req)
+	return nil
+}
+
+// claimServerRequest removes a pending request so that only its caller
+// answers it. It returns nil if there is none (or it was claimed already).
+func (s *Session) claimServerRequest(id string) *ServerRequest {
+	s.serverReqMu.Lock()
+	defer s.serverReqMu.Unlock()
+	req := s.serverRequests[id]
+	delete(s.serverRequests, id)
+	return req
+}
+
+// unclaimServerRequest puts back a request whose answer could not be written.
+func (s *Session) unclaimServerRequest(req *ServerRequest) {
+	s.serverReqMu.Lock()
+	s.serverRequests[req.ID] = req
+	s.serverReqMu.Unlock()
+}
+
+// publishResolved tells subscribers to dismiss a request once a response for
+// it has been written to codex.
+func (s *Session) publishResolved(req *ServerRequest) {
+
+	publishThreadJSON(s.events, "approval/resolved", req.ThreadID, map[string]any{
+		"id":       req.ID,
+		"method":   req.Method,
+		"threadId": req.ThreadID,
+	})
+}
@@ -2,60 +2,199 @@ package codex
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"climate/server/internal/events"
+	"climate/server/internal/policy"
 )
 
 var (
 	ErrMaxSessions     = errors.New("max sessions reached")
 	ErrCodexNotRunning = errors.New("codex app-server process is not running")
+	// ErrNotSent matches SendRPC errors returned before the message reached
+	// codex, so sending it again cannot repeat it. Any other error may come
+	// after codex acted on it.
+	ErrNotSent = errors.New("message was not sent to codex")
 )
 
+// notSentError marks err as ErrNotSent, keeping its message and chain.
+type notSentError struct{ err error }
+
+func (e notSentError) Error() string        { return e.err.Error() }
+func (e notSentError) Unwrap() error        { return e.err }
+func (e notSentError) Is(target error) bool { return target == ErrNotSent }
+
 const (
-	defaultMaxSessions = 16
-	defaultIdleTTL     = 10 * time.Minute
+	defaultMaxSessions     = 16
+	defaultIdleTTL         = 10 * time.Minute
+	defaultRPCTimeout      = 30 * time.Second
+	defaultHubCapacity     = 1024
+	defaultJanitorInterval = 30 * time.Second
 )
 
+// ManagerOptions sizes the bridge. Zero values fall back to the defaults.
+type ManagerOptions struct {
+	CodexBin string
+
+	// MaxSessions caps concurrently running codex app-servers.
+	MaxSessions int
+	// IdleTTL is how long a session may go without traffic before it is
+	// stopped. A negative value disables idle reaping.
+	IdleTTL time.Duration
+	// RPCTimeout bounds how long /rpc waits for codex to answer a request;
+	// MethodTimeouts overrides it per JSON-RPC method (case-insensitive).
+	RPCTimeout     time.Duration
+	MethodTimeouts map[string]time.Duration
+	// HubCapacity is the number of events retained in memory per client for
+	// replay.
+	HubCapacity int
+	// EventStoreDir, if set, persists each client's events under
+	// <dir>/<client> so replay reaches beyond HubCapacity and survives restarts.
+	EventStoreDir string
+	EventStore    events.StoreConfig
+	// ElideBytes is the size above which string fields in events are
+	// replaced by a reference to a blob (see Manager.Blob) on v2 streams.
+	// A negative value disables elision.
+	ElideBytes int
+	// MaxLineBytes caps a single line of codex output; a longer line is
+	// dropped with a session/error event and fails the request it answers.
+	// A negative value removes the cap.
+	MaxLineBytes int
+	// JanitorInterval is how often idle sessions are looked for.
+	JanitorInterval time.Duration
+
+	// StopGrace is how long each step of a graceful stop waits for codex to
+	// exit before escalating.
+	StopGrace time.Duration
+	// CgroupParent makes each codex session run in its own cgroup v2 under
+	// this directory (Linux only), in addition to its own process group.
+	CgroupParent string
+
+	// Policy answers matching approval requests on the client's behalf.
+	Policy *policy.Engine
+}
+
 type Manager struct {
-	mu          sync.Mutex
-	codexBin    string
-	sessions    map[string]*clientEntry
-	maxSessions int
-	idleTTL     time.Duration
+	mu              sync.Mutex
+	codexBin        string
+	sessions        map[string]*clientEntry
+	maxSessions     int
+	idleTTL         time.Duration
+	timeouts        rpcTimeouts
+	hubCapacity     int
+	storeDir        string
+	storeConfig     events.StoreConfig
+	elideBytes      int
+	maxLineBytes    int
+	janitorInterval time.Duration
+	policy          *policy.Engine
+	stopGrace       time.Duration
+	cgroupRoot      string
+	closed          bool
 
 	janitorOnce sync.Once
+	stopJanitor chan struct{}
 
 	running atomic.Int64
 }
 
 func NewManager(codexBin string) *Manager {
-	if strings.TrimSpace(codexBin) == "" {
+	return NewManagerWithOptions(ManagerOptions{CodexBin: codexBin})
+}
+
+func NewManagerWithOptions(opts ManagerOptions) *Manager {
+	codexBin := strings.TrimSpace(opts.CodexBin)
+	if codexBin == "" {
 		codexBin = "codex"
 	}
 	m := &Manager{
-		codexBin:    codexBin,
-		sessions:    make(map[string]*clientEntry),
-		maxSessions: defaultMaxSessions,
-		idleTTL:     defaultIdleTTL,
+		codexBin:        codexBin,
+		sessions:        make(map[string]*clientEntry),
+		maxSessions:     opts.MaxSessions,
+		idleTTL:         opts.IdleTTL,
+		timeouts:        newRPCTimeouts(opts.RPCTimeout, opts.MethodTimeouts),
+		hubCapacity:     opts.HubCapacity,
+		storeDir:        strings.TrimSpace(opts.EventStoreDir),
+		storeConfig:     opts.EventStore,
+		elideBytes:      opts.ElideBytes,
+		maxLineBytes:    opts.MaxLineBytes,
+		janitorInterval: opts.JanitorInterval,
+		policy:          opts.Policy,
+		stopGrace:       opts.StopGrace,
+		cgroupRoot:      strings.TrimSpace(opts.CgroupParent),
+		stopJanitor:     make(chan struct{}),
+	}
+	if m.maxSessions <= 0 {
+		m.maxSessions = defaultMaxSessions
+	}
+	if m.idleTTL == 0 {
+		m.idleTTL = defaultIdleTTL
+	}
+	if m.hubCapacity <= 0 {
+		m.hubCapacity = defaultHubCapacity
+	}
+	if m.elideBytes == 0 {
+		m.elideBytes = defaultElideBytes
+	}
+	if m.maxLineBytes == 0 {
+		m.maxLineBytes = defaultMaxLineBytes
+	}
+	if m.janitorInterval <= 0 {
+		m.janitorInterval = defaultJanitorInterval
+	}
+	if m.stopGrace <= 0 {
+		m.stopGrace = defaultStopGrace
 	}
 	m.startJanitor()
 	return m
 }
 
+// rpcTimeouts holds the default RPC timeout and per-method overrides, keyed
+// by lower-cased method name (viper lower-cases config keys).
+type rpcTimeouts struct {
+	fallback  time.Duration
+	perMethod map[string]time.Duration
+}
+
+func newRPCTimeouts(fallback time.Duration, perMethod map[string]time.Duration) rpcTimeouts {
+	if fallback <= 0 {
+		fallback = defaultRPCTimeout
+	}
+	t := rpcTimeouts{fallback: fallback, perMethod: make(map[string]time.Duration, len(perMethod))}
+	for method, timeout := range perMethod {
+		method = strings.ToLower(strings.TrimSpace(method))
+		if method != "" && timeout > 0 {
+			t.perMethod[method] = timeout
+		}
+	}
+	return t
+}
+
+func (t rpcTimeouts) forMethod(method string) time.Duration {
+	if timeout, ok := t.perMethod[strings.ToLower(method)]; ok {
+		return timeout
+	}
+	if t.fallback <= 0 {
+		return defaultRPCTimeout
+	}
+	return t.fallback
+}
+
 func (m *Manager) Ensure(clientKey string) (*Session, error) {
 	clientKey = strings.TrimSpace(clientKey)
 	if clientKey == "" {
@@ -76,11 +215,16 @@ func (m *Manager) Events(clientKey string) *events.Hub {
 }
 
 type SessionSnapshot struct {
-	ClientKey    string    `json:"clientKey"`
-	CodexRunning bool      `json:"codexRunning"`
-	LastActivity time.Time `json:"lastActivity,omitempty"`
-	LastEventID  uint64    `json:"lastEventId"`
-	HasEverRun   bool      `json:"hasEverRun"`
+	ClientKey        string          `json:"clientKey"`
+	CodexRunning     bool            `json:"codexRunning"`
+	LastActivity     time.Time       `json:"lastActivity,omitempty"`
+	LastEventID      uint64          `json:"lastEventId"`
+	Epoch            string          `json:"epoch"`
+	HasEverRun       bool            `json:"hasEverRun"`
+	LeaseUntil       time.Time       `json:"leaseUntil,omitzero"`
+	PendingApprovals []ServerRequest `json:"pendingApprovals"`
+	// Threads is the materialized state of recently active threads.
+	Threads []ThreadState `json:"threads"`
 }
 
 func (m *Manager) Snapshot(clientKey string) SessionSnapshot {
@@ -104,14 +248,91 @@ func (m *Manager) Snapshot(clientKey string) SessionSnapshot {
 		ClientKey:    clientKey,
 		HasEverRun:   entry.hasEverRun,
 		LastEventID:  entry.hub.HighWaterMark(),
+		Epoch:        entry.hub.Epoch(),
 		CodexRunning: entry.session != nil && !entry.session.Dead(),
 	}
 	if entry.session != nil {
 		snap.LastActivity = entry.session.LastActivity()
 	}
+	if entry.leaseUntil.After(time.Now()) {
+		snap.LeaseUntil = entry.leaseUntil
+	}
+	if snap.CodexRunning {
+		snap.PendingApprovals = entry.session.PendingRequests()
+	} else {
+		snap.PendingApprovals = []ServerRequest{}
+	}
+	snap.Threads = entry.threads.all()
+	for i := range snap.Threads {
+		snap.Threads[i].PendingApprovals = approvalsFor(snap.PendingApprovals, &snap.Threads[i])
+	}
 	return snap
 }
 
+// PendingRequests lists server requests awaiting a response for clientKey
+// without spawning codex.
+func (m *Manager) PendingRequests(clientKey string) []ServerRequest {
+	session := m.liveSession(clientKey)
+	if session == nil {
+		return []ServerRequest{}
+	}
+	return session.PendingRequests()
+}
+
+// Respond answers a pending server request on behalf of clientKey.
+func (m *Manager) Respond(clientKey, id string, result, rpcErr json.RawMessage) error {
+	session := m.liveSession(clientKey)
+	if session == nil {
+		return ErrRequestNotFound
+	}
+	return session.Respond(id, result, rpcErr)
+}
+
+// StderrLog returns up to limit recent codex stderr lines for clientKey.
+func (m *Manager) StderrLog(clientKey string, limit int) []LogLine {
+	clientKey = strings.TrimSpace(clientKey)
+	if clientKey == "" {
+		return []LogLine{}
+	}
+	return m.getOrCreate(clientKey).stderr.Lines(limit, 0)
+}
+
+// WatchStderr makes codex stderr lines for clientKey be published as
+// `codex/stderr` events until the returned func is called.
+func (m *Manager) WatchStderr(clientKey string) func() {
+	clientKey = strings.TrimSpace(clientKey)
+	if clientKey == "" {
+		return func() {}
+	}
+	entry := m.getOrCreate(clientKey)
+	entry.stderrWatchers.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { entry.stderrWatchers.Add(-1) })
+	}
+}
+
+func (m *Manager) liveSession(clientKey string) *Session {
+	clientKey = strings.TrimSpace(clientKey)
+	if clientKey == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	entry := m.sessions[clientKey]
+	m.mu.Unlock()
+	if entry == nil {
+		return nil
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.session == nil || entry.session.Dead() {
+		return nil
+	}
+	return entry.session
+}
+
 func (m *Manager) RunningSessions() int {
 	return int(m.running.Load())
 }
@@ -125,70 +346,38 @@ func (m *Manager) getOrCreate(clientKey string) *clientEntry {
 		return entry
 	}
 	entry = &clientEntry{
-		key: clientKey,
-		hub: events.NewHub(1024),
+		key:    clientKey,
+		hub:    m.newHub(clientKey),
+		stderr: newLogRing(stderrRingLines),
 	}
 	m.sessions[clientKey] = entry
 	return entry
 }
 
-func (m *Manager) startJanitor() {
-	m.janitorOnce.Do(func() {
-		go func() {
-			ticker := time.NewTicker(30 * time.Second)
-			defer ticker.Stop()
-			for range ticker.C {
-				m.sweepIdle()
-			}
-		}()
-	})
-}
-
-func (m *Manager) sweepIdle() {
-	ttl := m.idleTTL
-	if ttl <= 0 {
-		return
-	}
-	now := time.Now()
-
-	m.mu.Lock()
-	entries := make([]*clientEntry, 0, len(m.sessions))
-	for _, entry := range m.sessions {
-		entries = append(entries, entry)
-	}
-	m.mu.Unlock()
-
-	for _, entry := range entries {
-		entry.mu.Lock()
-		s := entry.session
-		entry.mu.Unlock()
-		if s == nil || s.Dead() {
-			continue
-		}
-		last := s.LastActivity()
-		if last.IsZero() {
-			continue
-		}
-		if now.Sub(last) < ttl {
-			continue
-		}
-
-		entry.mu.Lock()
-		if entry.session != nil && !entry.session.Dead() {
-			_ = entry.session.Kill()
-			entry.session = nil
-		}
-		entry.mu.Unlock()
-	}
-}
-
 type clientEntry struct {
 	key string
 	hub *events.Hub
 
+	stderr         *logRing
+	stderrWatchers atomic.Int32
+
 	mu         sync.Mutex
 	session    *Session
 	hasEverRun bool
+
+	// memory outlives individual sessions so a respawned codex can be
+	// brought back to the state the client left it in.
+	memory sessionMemory
+	// threads is the materialized state of the client's threads.
+	threads threadStates
+	// blobs holds large strings elided from the client's events.
+	blobs blobStore
+
+	crashes      int
+	restartTimer *time.Timer
+
+	// leaseUntil keeps the session from being reaped as idle until then.
+	leaseUntil time.Time
 }
 
 func (e *clientEntry) ensure(m *Manager) (*Session, error) {
@@ -199,22 +388,97 @@ func (e *clientEntry) ensure(m *Manager) (*Session, error) {
 		return e.session, nil
 	}
 
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if closed {
+		return nil, ErrManagerClosed
+	}
+
 	if err := m.acquireSlot(); err != nil {
 		return nil, err
 	}
 
-	session, err := spawnSession(m.codexBin, e.hub, func() {
-		m.running.Add(-1)
+	session, err := spawnSession(spawnConfig{
+		codexBin:     m.codexBin,
+		clientKey:    e.key,
+		hub:          e.hub,
+		policy:       m.policy,
+		timeouts:     m.timeouts,
+		cgroupRoot:   m.cgroupRoot,
+		memory:       &e.memory,
+		threads:      &e.threads,
+		blobs:        &e.blobs,
+		elideBytes:   m.elideBytes,
+		maxLineBytes: m.maxLineBytes,
+		stderr:       e.stderr,
+		watchers:     &e.stderrWatchers,
+		onDead: func() {
+			m.running.Add(-1)
+		},
+		onExit: func(s *Session, status exitStatus) {
+			e.handleExit(m, s, status)
+		},
 	})
 	if err != nil {
 		m.running.Add(-1)
 		return nil, err
 	}
+	if e.restartTimer != nil {
+		e.restartTimer.Stop()
+		e.restartTimer = nil
+	}
 	e.session = session
+	respawn := e.hasEverRun
 	e.hasEverRun = true
+
+	publishJSON(e.hub, "session/spawned", map[string]any{
+		"pid":     session.cmd.Process.Pid,
+		"respawn": respawn,
+	})
+
+	if respawn {
+		// Restoring can take a while; it must not hold e.mu, which every
+		// snapshot, lease and event subscription for the client takes.
+		go func() {
+			session.restore(&e.memory)
+			close(session.ready)
+		}()
+	} else {
+		close(session.ready)
+	}
 	return session, nil
 }
 
+// newHub creates a client's event hub, backed by the event store if one is
+// configured and it can be opened.
+func (m *Manager) newHub(clientKey string) *events.Hub {
+	if m.storeDir == "" {
+		return events.NewHub(m.hubCapacity)
+	}
+	dir := filepath.Join(m.storeDir, storeDirName(clientKey))
+	store, err := events.OpenStore(dir, m.storeConfig)
+	if err == nil {
+		var hub *events.Hub
+		if hub, err = events.NewHubWithStore(m.hubCapacity, store); err == nil {
+			return hub
+		}
+		_ = store.Close()
+	}
+	log.Printf("[codex] client=%s events kept in memory only: %v", clientKey, err)
+	return events.NewHub(m.hubCapacity)
+}
+
+// storeDirName turns a client key (which may contain '/') into a
+// single path element.
+func storeDirName(clientKey string) string {
+	name := url.PathEscape(clientKey)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
 func (m *Manager) acquireSlot() error {
 	for {
 		cur := m.running.Load()
@@ -231,23 +495,50 @@ type Session struct {
 	stdinMu sync.Mutex
 	stdin   io.WriteCloser
 
-	pending   map[string]chan []byte
+	// pending maps bridge-owned upstream ids to the client request waiting on them.
+	pending   map[string]*pendingCall
 	pendingMu sync.Mutex
+	nextID    atomic.Int64
+
+	serverReqMu    sync.Mutex
+	serverRequests map[string]*ServerRequest
 
 	cmd  *exec.Cmd
 	dead atomic.Bool
 
-	deadCh    chan struct{}
-	deadOnce  sync.Once
+	deadCh   chan struct{}
+	deadOnce sync.Once
+	// ready is closed once a respawned session has been restored; client
+	// requests wait for it.
+	ready     chan struct{}
 	lastNanos atomic.Int64
+	startedAt time.Time
+
+	stderr   *stderrWriter
+	cgroup   *cgroup
+	stopMu   sync.Mutex
+	stopping string
 
 	events *events.Hub
 
+	clientKey string
+	policy    *policy.Engine
+	timeouts  rpcTimeouts
+	items     itemCache
+	turns     turnTracker
+
 	onDead func()
 
 	initMu          sync.Mutex
 	initialized     bool
 	initializeReply json.RawMessage
+	initializedSent atomic.Bool
+
+	memory       *sessionMemory
+	threads      *threadStates
+	blobs        *blobStore
+	elideBytes   int
+	maxLineBytes int
 }
 
 func (s *Session) Dead() bool {
@@ -271,11 +562,14 @@ func (s *Session) markDead() {
 		s.dead.Store(true)
 		close(s.deadCh)
 		s.pendingMu.Lock()
-		for id, ch := range s.pending {
+		for id, call := range s.pending {
 			delete(s.pending, id)
-			close(ch)
+			close(call.ch)
 		}
 		s.pendingMu.Unlock()
+		s.serverReqMu.Lock()
+		clear(s.serverRequests)
+		s.serverReqMu.Unlock()
 		if s.onDead != nil {
 			s.onDead()
 		}
@@ -283,18 +577,37 @@ func (s *Session) markDead() {
 }
 
 func (s *Session) Kill() error {
+	s.markStopping(exitKilled)
 	if s.cmd == nil || s.cmd.Process == nil {
 		s.markDead()
 		return nil
 	}
-	err := s.cmd.Process.Kill()
+	err := s.signalTree(syscall.SIGKILL)
 	s.markDead()
 	return err
 }
 
+// SendRPC forwards a client message to codex, once a respawned session has
+// been restored.
 func (s *Session) SendRPC(ctx context.Context, payload map[string]any) ([]byte, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case <-s.ready:
+	case <-s.deadCh:
+		return nil, notSentError{ErrCodexNotRunning}
+	case <-ctx.Done():
+		return nil, notSentError{ctx.Err()}
+	}
+	return s.send(ctx, payload, false)
+}
+
+// send forwards payload to codex. Internal requests are issued by the bridge
+// itself, so their responses are not published to the client's event hub.
+func (s *Session) send(ctx context.Context, payload map[string]any, internal bool) ([]byte, error) {
 	if s.Dead() {
-		return nil, ErrCodexNotRunning
+		return nil, notSentError{ErrCodexNotRunning}
 	}
 	if ctx == nil {
 		ctx = context.Background()
@@ -325,54 +638,94 @@ func (s *Session) SendRPC(ctx context.Context, payload map[string]any) ([]byte,
 		}
 	}
 
-	idKey, hasID := jsonIDKey(payload["id"])
-	_, hasMethod := payload["method"]
-	isRequest := hasMethod && hasID
+	clientID, hasID := payload["id"]
+	method, hasMethod := payload["method"].(string)
+	isRequest := hasMethod && hasID && clientID != nil
 
-	var respCh chan []byte
+	if method == "initialized" && !hasID {
+		// Already sent by the bridge when it restored a respawned session.
+		if !s.initializedSent.CompareAndSwap(false, true) {
+			return []byte(`{"ok":true}`), nil
+		}
+	}
+
+	// Client requests are forwarded under a bridge-owned id so that several
+	// callers (or a codex-initiated request) reusing the same id never collide.
+	// Notifications and responses to codex-initiated requests pass through as-is.
+	forward := payload
+	var idKey string
+	var call *pendingCall
 	if isRequest {
-		respCh = make(chan []byte, 1)
+		rawClientID, err := json.Marshal(clientID)
+		if err != nil {
+			return nil, notSentError{fmt.Errorf("failed to serialize rpc id: %w", err)}
+		}
+		upstreamID := s.nextID.Add(1)
+		idKey = strconv.FormatInt(upstreamID, 10)
+		call = &pendingCall{
+			clientID: rawClientID,
+			method:   method,
+			params:   payload["params"],
+			ch:       make(chan []byte, 1),
+			internal: internal,
+		}
+
+		forward = make(map[string]any, len(payload))
+		for k, v := range payload {
+			forward[k] = v
+		}
+		forward["id"] = upstreamID
+
 		s.pendingMu.Lock()
-		s.pending[idKey] = respCh
+		s.pending[idKey] = call
 		s.pendingMu.Unlock()
 	}
-
-	line, err := json.Marshal(payload)
-	if err != nil {
-		if isRequest {
-			s.pendingMu.Lock()
-			delete(s.pending, idKey)
-			s.pendingMu.Unlock()
+	// An answer to a codex request claims it like Respond does.
+	var answered *ServerRequest
+	if !hasMethod && hasID {
+		if key, ok := jsonIDKey(clientID); ok {
+			answered = s.claimServerRequest(key)
 		}
-		return nil, fmt.Errorf("failed to serialize rpc payload: %w", err)
 	}
 
-	s.stdinMu.Lock()
-	_, err = s.stdin.Write(append(line, '\n'))
-	s.stdinMu.Unlock()
+	line, err := json.Marshal(forward)
+	if err != nil {
+		err = fmt.Errorf("failed to serialize rpc payload: %w", err)
+	} else {
+		err = s.writeLine(line)
+	}
 	if err != nil {
 		if isRequest {
-			s.pendingMu.Lock()
-			delete(s.pending, idKey)
-			s.pendingMu.Unlock()
+			s.dropPending(idKey)
+		}
+		if answered != nil {
+			s.unclaimServerRequest(answered)
 		}
-		return nil, fmt.Errorf("failed to write to codex app-server stdin: %w", err)
+		return nil, notSentError{err}
+	}
+	if s.memory != nil && !internal {
+		s.memory.observeRequest(method, payload["params"])
 	}
-	s.touch()
 
 	if !isRequest {
+		if answered != nil {
+			s.publishResolved(answered)
+		}
 		return []byte(`{"ok":true}`), nil
 	}
 
-	timeoutCtx, cancel := withTimeout(ctx, 30*time.Second)
+	timeoutCtx, cancel := withTimeout(ctx, s.timeouts.forMethod(method))
 	defer cancel()
 
 	select {
-	case resp, ok := <-respCh:
+	case resp, ok := <-call.ch:
 		if !ok {
+			if call.err != nil {
+				return nil, call.err
+			}
 			return nil, ErrCodexNotRunning
 		}
-		if method, _ := payload["method"].(string); method == "initialize" {
+		if method == "initialize" {
 			var decoded struct {
 				Result json.RawMessage `json:"result"`
 				Error  json.RawMessage `json:"error"`
@@ -386,47 +739,164 @@ func (s *Session) SendRPC(ctx context.Context, payload map[string]any) ([]byte,
 		}
 		return resp, nil
 	case <-s.deadCh:
-		s.pendingMu.Lock()
-		delete(s.pending, idKey)
-		s.pendingMu.Unlock()
+		s.dropPending(idKey)
 		return nil, ErrCodexNotRunning
 	case <-timeoutCtx.Done():
-		s.pendingMu.Lock()
-		delete(s.pending, idKey)
-		s.pendingMu.Unlock()
+		s.dropPending(idKey)
 		return nil, fmt.Errorf("rpc timed out: %w", timeoutCtx.Err())
 	}
 }
 
-func spawnSession(codexBin string, hub *events.Hub, onDead func()) (*Session, error) {
+func (s *Session) writeLine(line []byte) error {
+	s.stdinMu.Lock()
+	_, err := s.stdin.Write(append(line, '\n'))
+	s.stdinMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to write to codex app-server stdin: %w", err)
+	}
+	s.touch()
+	return nil
+}
+
+func (s *Session) dropPending(idKey string) {
+	s.pendingMu.Lock()
+	delete(s.pending, idKey)
+	s.pendingMu.Unlock()
+}
+
+type spawnConfig struct {
+	codexBin     string
+	clientKey    string
+	hub          *events.Hub
+	policy       *policy.Engine
+	timeouts     rpcTimeouts
+	cgroupRoot   string
+	memory       *sessionMemory
+	threads      *threadStates
+	blobs        *blobStore
+	elideBytes   int
+	maxLineBytes int
+	stderr       *logRing
+	watchers     *atomic.Int32
+	onDead       func()
+	onExit       func(*Session, exitStatus)
+}
+
+// cgroupSeq names session cgroups, which are created before the process
+// they hold.
+var cgroupSeq atomic.Uint64
+
+// newCodexCmd prepares `codex app-server` with its pipes.
+func newCodexCmd(codexBin string, stderr *stderrWriter) (*exec.Cmd, io.WriteCloser, io.ReadCloser, error) {
 	cmd := exec.Command(codexBin, "app-server")
-	cmd.Stdin = nil
-	cmd.Stdout = nil
-	cmd.Stderr = os.Stderr
+	stderr.cmd = cmd
+	cmd.Stderr = stderr
+	// Tool processes may inherit stderr; don't let them keep Wait blocked
+	// after the app-server itself is gone.
+	cmd.WaitDelay = reapTimeout
+	configureProcessGroup(cmd)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return nil, fmt.Errorf("codex app-server stdin unavailable: %w", err)
+		return nil, nil, nil, fmt.Errorf("codex app-server stdin unavailable: %w", err)
 	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, fmt.Errorf("codex app-server stdout unavailable: %w", err)
+		return nil, nil, nil, fmt.Errorf("codex app-server stdout unavailable: %w", err)
+	}
+	return cmd, stdin, stdout, nil
+}
+
+// startCodex starts `codex app-server`, inside group if set, so nothing it
+// forks can escape it. If the kernel cannot start it there (before Linux
+// 5.7), it is started as usual and the caller moves it in.
+func startCodex(codexBin string, stderr *stderrWriter, group *cgroup) (*exec.Cmd, io.WriteCloser, io.ReadCloser, error) {
+	cmd, stdin, stdout, err := newCodexCmd(codexBin, stderr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if group != nil {
+		release, err := group.place(cmd)
+		if err == nil {
+			err = cmd.Start()
+			release()
+			if err == nil {
+				return cmd, stdin, stdout, nil
+			}
+		}
+		log.Printf("[codex] cannot start inside cgroup, moving it there after start: %v", err)
+		// A failed Start closes the pipes; begin again.
+		if cmd, stdin, stdout, err = newCodexCmd(codexBin, stderr); err != nil {
+			return nil, nil, nil, err
+		}
 	}
 	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start `%s app-server`: %w", codexBin, err)
+		return nil, nil, nil, fmt.Errorf("failed to start `%s app-server`: %w", codexBin, err)
 	}
+	return cmd, stdin, stdout, nil
+}
 
+func spawnSession(cfg spawnConfig) (*Session, error) {
+	codexBin, hub := cfg.codexBin, cfg.hub
+	if cfg.stderr == nil {
+		cfg.stderr = newLogRing(stderrRingLines)
+	}
 	if hub == nil {
-		hub = events.NewHub(1024)
+		hub = events.NewHub(defaultHubCapacity)
+	}
+	stderr := &stderrWriter{
+		clientKey: cfg.clientKey,
+		ring:      cfg.stderr,
+		hub:       hub,
+		watchers:  cfg.watchers,
+	}
+
+	var group *cgroup
+	if cfg.cgroupRoot != "" {
+		cg, err := newCgroup(cfg.cgroupRoot, fmt.Sprintf("climate-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+		if err != nil {
+			log.Printf("[codex] client=%s running without cgroup: %v", cfg.clientKey, err)
+		} else {
+			group = cg
+		}
+	}
+
+	cmd, stdin, stdout, err := startCodex(codexBin, stderr, group)
+	if err != nil {
+		if group != nil {
+			group.remove()
+		}
+		return nil, err
+	}
+	if group != nil && !group.holds(cmd.Process.Pid) {
+		// Started outside it: move it in, missing anything it forked first.
+		if err := group.add(cmd.Process.Pid); err != nil {
+			log.Printf("[codex] client=%s running without cgroup: %v", cfg.clientKey, err)
+			group.remove()
+			group = nil
+		}
 	}
 
 	session := &Session{
-		stdin:   stdin,
-		pending: make(map[string]chan []byte),
-		cmd:     cmd,
-		deadCh:  make(chan struct{}),
-		events:  hub,
-		onDead:  onDead,
+		stdin:          stdin,
+		pending:        make(map[string]*pendingCall),
+		serverRequests: make(map[string]*ServerRequest),
+		cmd:            cmd,
+		deadCh:         make(chan struct{}),
+		ready:          make(chan struct{}),
+		events:         hub,
+		clientKey:      cfg.clientKey,
+		policy:         cfg.policy,
+		timeouts:       cfg.timeouts,
+		memory:         cfg.memory,
+		threads:        cfg.threads,
+		blobs:          cfg.blobs,
+		elideBytes:     cfg.elideBytes,
+		maxLineBytes:   cfg.maxLineBytes,
+		onDead:         cfg.onDead,
+		startedAt:      time.Now(),
+		stderr:         stderr,
+		cgroup:         group,
 	}
 	session.touch()
 
@@ -435,44 +905,122 @@ func spawnSession(codexBin string, hub *events.Hub, onDead func()) (*Session, er
 		if err := cmd.Wait(); err != nil {
 			log.Printf("[codex] app-server exited: %v", err)
 		}
+		stderr.Flush()
+		survivors := session.reapDescendants()
 		session.markDead()
+		if cfg.onExit != nil {
+			status := session.exitStatus(cmd.ProcessState)
+			status.Survivors = survivors
+			cfg.onExit(session, status)
+		}
 	}()
 
 	return session, nil
 }
 
 func (s *Session) readStdoutLoop(stdout io.ReadCloser) {
-	scanner := bufio.NewScanner(stdout)
-	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		s.events.Publish(events.Event{Type: "codex/stdout", Data: string(line)})
-		idKey, ok := extractIDKey(line)
-		if !ok {
+	reader := bufio.NewReaderSize(stdout, stdoutBuffer)
+	for {
+		line, size, tooLong, err := readLine(reader, s.maxLineBytes)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("[codex] stdout read error: %v", err)
+			}
+			return
+		}
+		s.touch()
+		if tooLong {
+			s.handleOversizedLine(line, size)
 			continue
 		}
+		s.handleLine(line)
+	}
+}
+
+func (s *Session) handleLine(line []byte) {
+	msg, err := decodeMessage(line)
+	if err == nil && msg.isResponse() {
+		s.handleResponse(msg, line)
+		return
+	}
+	// Notifications and codex-initiated requests (which carry both
+	// `method` and codex's own `id`) are forwarded untouched, unless
+	// the approval policy answers the request on the client's behalf.
+	if err == nil {
+		s.turns.observeNotification(msg)
+	}
+	if err == nil && s.memory != nil {
+		s.memory.observeNotification(msg)
+	}
+	if err == nil && s.policy != nil {
+		s.items.observe(msg)
+		if msg.isRequest() && s.applyPolicy(msg) {
+			return
+		}
+	}
+	evt := events.Event{Type: "codex/stdout", Kind: events.KindNotification, Data: line}
+	if err == nil {
+		evt.Elided = s.elide(line)
+		scope := msg.scope()
+		evt.Method = msg.Method
+		evt.ThreadID = scope.threadID()
+		evt.ItemID = scope.itemID()
+		if msg.isRequest() {
+			evt.Kind = events.KindServerRequest
+		}
+	} else {
+		// Keep Data valid JSON for every event: pass garbage on as a string
+		// (the v1 stream sends it unquoted).
+		evt.Kind = events.KindBridge
+		evt.Data, _ = json.Marshal(string(line))
+	}
+	eventID := s.events.Publish(evt)
+	if err == nil && msg.isRequest() {
+		s.trackServerRequest(msg, eventID)
+	}
+	if s.threads != nil {
+		evt.ID = eventID
+		s.threads.apply(evt)
+	}
+}
+
+func (s *Session) handleResponse(msg rpcMessage, line []byte) {
+	idKey, ok := msg.idKey()
+	var call *pendingCall
+	if ok {
 		s.pendingMu.Lock()
-		respCh := s.pending[idKey]
+		call = s.pending[idKey]
 		delete(s.pending, idKey)
 		s.pendingMu.Unlock()
-		if respCh != nil {
-			respCh <- append([]byte(nil), line...)
-			close(respCh)
-		}
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("[codex] stdout read error: %v", err)
+	if call == nil {
+		s.events.Publish(events.Event{Type: "codex/stdout", Kind: events.KindResponse, Data: line})
+		return
 	}
-}
 
-func extractIDKey(line []byte) (string, bool) {
-	decoder := json.NewDecoder(bytes.NewReader(line))
-	decoder.UseNumber()
-	var payload map[string]any
-	if err := decoder.Decode(&payload); err != nil {
-		return "", false
+	out, err := replaceID(line, call.clientID)
+	if err != nil {
+		log.Printf("[codex] failed to restore client id for upstream id %s: %v", idKey, err)
+		out = line
+	}
+	// Observe before handing the response over, so that notifications
+	// following it on stdout are applied on top.
+	s.turns.observeResponse(call.method, call.params, out)
+	if s.memory != nil {
+		s.memory.observeResponse(call.method, out)
+	}
+	if !call.internal {
+		s.events.Publish(events.Event{
+			Type:     "codex/stdout",
+			Kind:     events.KindResponse,
+			Data:     out,
+			Elided:   s.elide(out),
+			Method:   call.method,
+			ThreadID: responseThreadID(call, msg),
+		})
 	}
-	return jsonIDKey(payload["id"])
+	call.ch <- out
+	close(call.ch)
 }
 
 func jsonIDKey(value any) (string, bool) {
@@ -0,0 +1,122 @@
+package codex
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrManagerClosed = errors.New("session manager is shutting down")
+
+const (
+	defaultStopGrace = 5 * time.Second
+
+	exitShutdown = "shutdown"
+)
+
+// stop shuts codex down gracefully: it interrupts the turns the bridge knows
+// are in flight and closes stdin, then escalates to SIGTERM and finally
+// SIGKILL, waiting up to grace after each step. It returns early (with
+// SIGKILL) if ctx is done first.
+func (s *Session) stop(ctx context.Context, grace time.Duration, reason string) error {
+	s.markStopping(reason)
+	if s.Dead() {
+		return nil
+	}
+	if grace <= 0 {
+		grace = defaultStopGrace
+	}
+
+	graceCtx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, turn := range s.turns.active() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			params := map[string]any{"threadId": turn.ThreadID, "turnId": turn.TurnID}
+			if err := s.call(graceCtx, "turn/interrupt", params); err != nil {
+				log.Printf("[codex] client=%s failed to interrupt turn %s: %v", s.clientKey, turn.TurnID, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.stdinMu.Lock()
+	_ = s.stdin.Close()
+	s.stdinMu.Unlock()
+	if s.waitDead(graceCtx) {
+		return nil
+	}
+
+	if s.cmd != nil && s.cmd.Process != nil && ctx.Err() == nil {
+		log.Printf("[codex] client=%s app-server did not exit after %s; sending SIGTERM", s.clientKey, grace)
+		_ = s.signalTree(syscall.SIGTERM)
+		termCtx, cancel := context.WithTimeout(ctx, grace)
+		defer cancel()
+		if s.waitDead(termCtx) {
+			return nil
+		}
+	}
+
+	log.Printf("[codex] client=%s app-server still running; sending SIGKILL", s.clientKey)
+	return s.Kill()
+}
+
+func (s *Session) waitDead(ctx context.Context) bool {
+	select {
+	case <-s.deadCh:
+		return true
+	case <-ctx.Done():
+		return s.Dead()
+	}
+}
+
+// Close gracefully stops every codex session and rejects new ones. It
+// returns ctx.Err() if some sessions had to be killed when ctx expired.
+func (m *Manager) Close(ctx context.Context) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.stopJanitor)
+	entries := make([]*clientEntry, 0, len(m.sessions))
+	for _, entry := range m.sessions {
+		entries = append(entries, entry)
+	}
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, entry := range entries {
+		entry.mu.Lock()
+		if entry.restartTimer != nil {
+			entry.restartTimer.Stop()
+			entry.restartTimer = nil
+		}
+		session := entry.session
+		entry.session = nil
+		entry.mu.Unlock()
+		if session == nil || session.Dead() {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = session.stop(ctx, m.stopGrace, exitShutdown)
+		}()
+	}
+	wg.Wait()
+
+	// Ends event streams and releases the on-disk event logs.
+	for _, entry := range entries {
+		entry.hub.Close()
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,132 @@
+package codex
+
+import (
+	"bytes"
+	"log"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"climate/server/internal/events"
+)
+
+const (
+	stderrRingLines = 500
+	stderrTailLines = 20
+	stderrMaxLine   = 4 << 10
+)
+
+// LogLine is one line codex wrote to stderr.
+type LogLine struct {
+	Time time.Time `json:"time"`
+	PID  int       `json:"pid"`
+	Text string    `json:"text"`
+}
+
+// logRing keeps the most recent stderr lines of every codex process a client
+// has run, so they survive the process that wrote them.
+type logRing struct {
+	mu    sync.Mutex
+	max   int
+	lines []LogLine
+	start int
+}
+
+func newLogRing(max int) *logRing {
+	return &logRing{max: max, lines: make([]LogLine, 0, max)}
+}
+
+func (r *logRing) add(line LogLine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) < r.max {
+		r.lines = append(r.lines, line)
+		return
+	}
+	r.lines[r.start] = line
+	r.start = (r.start + 1) % r.max
+}
+
+// Lines returns up to limit of the newest lines (all if limit <= 0), oldest
+// first, optionally restricted to one pid.
+func (r *logRing) Lines(limit int, pid int) []LogLine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]LogLine, 0, len(r.lines))
+	for i := range r.lines {
+		line := r.lines[(r.start+i)%len(r.lines)]
+		if pid != 0 && line.PID != pid {
+			continue
+		}
+		out = append(out, line)
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return out
+}
+
+// stderrWriter splits a codex process's stderr into lines, records them in
+// the client's ring and, when someone asked for them, publishes them as
+// `codex/stderr` events.
+type stderrWriter struct {
+	cmd       *exec.Cmd
+	clientKey string
+	ring      *logRing
+	hub       *events.Hub
+	watchers  *atomic.Int32
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *stderrWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(data[:i])
+		data = data[i+1:]
+	}
+	if len(data) > stderrMaxLine {
+		w.emit(data)
+		data = nil
+	}
+	w.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// Flush emits a trailing unterminated line, if any.
+func (w *stderrWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.emit(w.partial)
+		w.partial = nil
+	}
+}
+
+func (w *stderrWriter) emit(raw []byte) {
+	raw = bytes.TrimRight(raw, "\r")
+	if len(raw) > stderrMaxLine {
+		raw = raw[:stderrMaxLine]
+	}
+	line := LogLine{Time: time.Now(), Text: string(raw)}
+	// The copying goroutine is started after cmd.Process is set.
+	if w.cmd.Process != nil {
+		line.PID = w.cmd.Process.Pid
+	}
+
+	log.Printf("[codex stderr] client=%s pid=%d %s", w.clientKey, line.PID, line.Text)
+	w.ring.add(line)
+	if w.watchers != nil && w.watchers.Load() > 0 {
+		publishJSON(w.hub, "codex/stderr", line)
+	}
+}
@@ -0,0 +1,168 @@
+package codex
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"climate/server/internal/events"
+)
+
+const (
+	restartBaseDelay = 500 * time.Millisecond
+	restartMaxDelay  = 30 * time.Second
+
+	// A process that dies within fastCrashWindow of starting counts towards
+	// maxFastCrashes; after that many in a row the supervisor gives up.
+	fastCrashWindow = 10 * time.Second
+	maxFastCrashes  = 5
+)
+
+const (
+	exitCrash  = "crash"
+	exitIdle   = "idle"
+	exitKilled = "killed"
+)
+
+// exitStatus is the payload of `session/exited`.
+type exitStatus struct {
+	PID      int      `json:"pid"`
+	Reason   string   `json:"reason"`
+	ExitCode int      `json:"exitCode"`
+	Signal   string   `json:"signal,omitempty"`
+	UptimeMs int64    `json:"uptimeMs"`
+	Stderr   []string `json:"stderr,omitempty"`
+
+	// Survivors are descendants still alive after the process tree was killed.
+	Survivors []int `json:"survivors,omitempty"`
+}
+
+func (s *Session) exitStatus(state *os.ProcessState) exitStatus {
+	status := exitStatus{
+		Reason:   s.stopReason(),
+		ExitCode: -1,
+		UptimeMs: time.Since(s.startedAt).Milliseconds(),
+	}
+	if s.cmd != nil && s.cmd.Process != nil {
+		status.PID = s.cmd.Process.Pid
+	}
+	if state != nil {
+		status.ExitCode = state.ExitCode()
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			status.Signal = ws.Signal().String()
+		}
+	}
+	if s.stderr != nil {
+		for _, line := range s.stderr.ring.Lines(stderrTailLines, status.PID) {
+			status.Stderr = append(status.Stderr, line.Text)
+		}
+	}
+	return status
+}
+
+func (s *Session) stopReason() string {
+	s.stopMu.Lock()
+	defer s.stopMu.Unlock()
+	if s.stopping == "" {
+		return exitCrash
+	}
+	return s.stopping
+}
+
+// markStopping records that the bridge itself is about to stop the process,
+// so its exit is not treated as a crash.
+func (s *Session) markStopping(reason string) {
+	s.stopMu.Lock()
+	defer s.stopMu.Unlock()
+	if s.stopping == "" {
+		s.stopping = reason
+	}
+}
+
+// handleExit publishes `session/exited` and, for crashes, schedules a restart
+// while somebody is listening on the hub.
+func (e *clientEntry) handleExit(m *Manager, s *Session, status exitStatus) {
+	log.Printf("[codex] client=%s app-server pid=%d exited (%s, code=%d)", e.key, status.PID, status.Reason, status.ExitCode)
+	publishJSON(e.hub, "session/exited", status)
+	if status.Reason != exitCrash {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session != s {
+		return
+	}
+	if time.Duration(status.UptimeMs)*time.Millisecond < fastCrashWindow {
+		e.crashes++
+	} else {
+		e.crashes = 1
+	}
+	e.scheduleRestart(m)
+}
+
+// scheduleRestart must be called with e.mu held.
+func (e *clientEntry) scheduleRestart(m *Manager) {
+	if e.hub.Subscribers() == 0 {
+		// Nobody is watching; the next /rpc respawns lazily.
+		return
+	}
+	if e.crashes >= maxFastCrashes {
+		log.Printf("[codex] client=%s giving up after %d fast crashes", e.key, e.crashes)
+		publishJSON(e.hub, "session/failed", map[string]any{
+			"crashes": e.crashes,
+			"message": "codex app-server keeps crashing on startup; not restarting automatically",
+		})
+		return
+	}
+
+	delay := restartBackoff(e.crashes)
+	publishJSON(e.hub, "session/restarting", map[string]any{
+		"attempt": e.crashes,
+		"delayMs": delay.Milliseconds(),
+	})
+	if e.restartTimer != nil {
+		e.restartTimer.Stop()
+	}
+	e.restartTimer = time.AfterFunc(delay, func() {
+		e.restart(m)
+	})
+}
+
+func (e *clientEntry) restart(m *Manager) {
+	if e.hub.Subscribers() == 0 {
+		return
+	}
+	if _, err := e.ensure(m); err != nil {
+		log.Printf("[codex] client=%s restart failed: %v", e.key, err)
+		e.mu.Lock()
+		e.crashes++
+		e.scheduleRestart(m)
+		e.mu.Unlock()
+	}
+}
+
+func restartBackoff(attempt int) time.Duration {
+	delay := restartBaseDelay
+	for i := 1; i < attempt && delay < restartMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, restartMaxDelay)
+}
+
+func publishJSON(hub *events.Hub, eventType string, v any) uint64 {
+	return publishThreadJSON(hub, eventType, "", v)
+}
+
+// publishThreadJSON publishes a bridge event about one thread, tagged so
+// that thread-filtered subscribers receive it.
+func publishThreadJSON(hub *events.Hub, eventType, threadID string, v any) uint64 {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[codex] failed to encode %s event: %v", eventType, err)
+		return 0
+	}
+	return hub.Publish(events.Event{Type: eventType, Kind: events.KindBridge, Data: data, ThreadID: threadID})
+}
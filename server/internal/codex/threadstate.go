@@ -0,0 +1,384 @@
+package codex
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+
+	"climate/server/internal/events"
+)
+
+const (
+	// maxThreadStates bounds how many threads a client entry materializes;
+	// the least recently updated one is dropped first.
+	maxThreadStates = 32
+	// maxItemDeltaBytes caps the text accumulated from deltas per item.
+	maxItemDeltaBytes = 1 << 20
+	// maxItemParts bounds reasoning summary/content indexes.
+	maxItemParts = 256
+
+	statusInProgress = "inProgress"
+	statusCompleted  = "completed"
+)
+
+// ThreadState is the bridge's view of a thread, folded from the event
+// stream: its current (or last) turn with that turn's items, token usage
+// and pending approvals. It is current as of EventID, so a client can render
+// it and stream from there.
+type ThreadState struct {
+	ThreadID string `json:"threadId"`
+	EventID  uint64 `json:"eventId"`
+	Epoch    string `json:"epoch,omitempty"`
+	// Thread is the thread object from thread/started, if seen.
+	Thread           json.RawMessage `json:"thread,omitempty"`
+	Turn             *TurnState      `json:"turn,omitempty"`
+	TokenUsage       json.RawMessage `json:"tokenUsage,omitempty"`
+	PendingApprovals []ServerRequest `json:"pendingApprovals"`
+}
+
+type TurnState struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Turn is the turn object from the latest turn/* notification.
+	Turn  json.RawMessage `json:"turn,omitempty"`
+	Items []ItemState     `json:"items"`
+	// Plan is the latest turn/plan/updated params; Diff the latest
+	// turn/diff/updated diff.
+	Plan json.RawMessage `json:"plan,omitempty"`
+	Diff string          `json:"diff,omitempty"`
+}
+
+// ItemState is one thread item. While it is in progress Text (agent
+// message and plan deltas), Output (command and file change output), Summary
+// and Content (reasoning, by index) accumulate its deltas; once completed
+// Item holds the final object and the accumulated fields are dropped.
+type ItemState struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Status    string          `json:"status"`
+	Item      json.RawMessage `json:"item,omitempty"`
+	Text      string          `json:"text,omitempty"`
+	Output    string          `json:"output,omitempty"`
+	Summary   []string        `json:"summary,omitempty"`
+	Content   []string        `json:"content,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+// threadStates is the reducer behind ThreadState. It lives on the client
+// entry so it survives respawns, and is fed codex notifications in stream
+// order.
+type threadStates struct {
+	mu      sync.Mutex
+	eventID uint64
+	threads map[string]*threadState
+}
+
+type threadState struct {
+	id         string
+	thread     json.RawMessage
+	turn       *turnState
+	tokenUsage json.RawMessage
+	// updated is the id of the last event about this thread.
+	updated uint64
+}
+
+type turnState struct {
+	id     string
+	status string
+	turn   json.RawMessage
+	plan   json.RawMessage
+	diff   string
+	items  []*itemState
+	byID   map[string]*itemState
+}
+
+type itemState struct {
+	id        string
+	itemType  string
+	status    string
+	item      json.RawMessage
+	text      []byte
+	output    []byte
+	summary   [][]byte
+	content   [][]byte
+	size      int
+	truncated bool
+}
+
+// threadParams holds the notification params the reducer reads.
+type threadParams struct {
+	TurnID       string          `json:"turnId"`
+	Thread       json.RawMessage `json:"thread"`
+	Turn         json.RawMessage `json:"turn"`
+	Item         json.RawMessage `json:"item"`
+	Delta        string          `json:"delta"`
+	Diff         string          `json:"diff"`
+	TokenUsage   json.RawMessage `json:"tokenUsage"`
+	SummaryIndex int             `json:"summaryIndex"`
+	ContentIndex int             `json:"contentIndex"`
+}
+
+type objectHeader struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// apply folds an event published from codex stdout into the state. Every
+// such event advances the state's EventID, even if it changes nothing.
+func (r *threadStates) apply(evt events.Event) {
+	var msg rpcMessage
+	var params threadParams
+	relevant := evt.Kind == events.KindNotification && evt.ThreadID != "" &&
+		json.Unmarshal(evt.Data, &msg) == nil && json.Unmarshal(msg.Params, &params) == nil
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.eventID = evt.ID
+	if !relevant {
+		return
+	}
+	t := r.thread(evt.ThreadID)
+	t.updated = evt.ID
+
+	switch evt.Method {
+	case "thread/started":
+		t.thread = params.Thread
+	case "turn/started", "turn/completed":
+		var header objectHeader
+		if json.Unmarshal(params.Turn, &header) != nil || header.ID == "" {
+			return
+		}
+		turn := t.turnFor(header.ID)
+		turn.turn = params.Turn
+		turn.status = header.Status
+		if turn.status == "" {
+			turn.status = statusInProgress
+			if evt.Method == "turn/completed" {
+				turn.status = statusCompleted
+			}
+		}
+	case "turn/plan/updated":
+		t.turnFor(params.TurnID).plan = msg.Params
+	case "turn/diff/updated":
+		t.turnFor(params.TurnID).diff = params.Diff
+	case "thread/tokenUsage/updated":
+		t.tokenUsage = params.TokenUsage
+	case "item/started", events.ItemCompletedMethod:
+		var header objectHeader
+		if json.Unmarshal(params.Item, &header) != nil || header.ID == "" {
+			return
+		}
+		item := t.turnFor(params.TurnID).itemFor(header.ID, header.Type)
+		item.item = params.Item
+		item.status = statusInProgress
+		if evt.Method == events.ItemCompletedMethod {
+			item.status = statusCompleted
+			item.text, item.output, item.summary, item.content, item.size = nil, nil, nil, nil, 0
+		}
+	default:
+		if evt.ItemID == "" || !strings.HasPrefix(evt.Method, "item/") {
+			return
+		}
+		itemType, part, _ := strings.Cut(strings.TrimPrefix(evt.Method, "item/"), "/")
+		if part != "summaryPartAdded" && !strings.HasSuffix(strings.ToLower(part), "delta") {
+			return
+		}
+		item := t.turnFor(params.TurnID).itemFor(evt.ItemID, itemType)
+		if item.status != statusCompleted {
+			item.applyDelta(part, params.Delta, params.SummaryIndex, params.ContentIndex)
+		}
+	}
+}
+
+func (r *threadStates) thread(id string) *threadState {
+	if r.threads == nil {
+		r.threads = make(map[string]*threadState)
+	}
+	if t := r.threads[id]; t != nil {
+		return t
+	}
+	if len(r.threads) >= maxThreadStates {
+		var oldest *threadState
+		for _, t := range r.threads {
+			if oldest == nil || t.updated < oldest.updated {
+				oldest = t
+			}
+		}
+		delete(r.threads, oldest.id)
+	}
+	t := &threadState{id: id}
+	r.threads[id] = t
+	return t
+}
+
+// turnFor returns the thread's current turn, starting a new one (which
+// drops the previous turn's items) when id names another turn. An empty id
+// means the current turn.
+func (t *threadState) turnFor(id string) *turnState {
+	if t.turn != nil && t.turn.id == "" {
+		t.turn.id = id
+	}
+	if t.turn == nil || id != "" && t.turn.id != id {
+		t.turn = &turnState{id: id, status: statusInProgress, byID: make(map[string]*itemState)}
+	}
+	return t.turn
+}
+
+func (t *turnState) itemFor(id, itemType string) *itemState {
+	item := t.byID[id]
+	if item == nil {
+		item = &itemState{id: id, status: statusInProgress}
+		t.byID[id] = item
+		t.items = append(t.items, item)
+	}
+	if item.itemType == "" {
+		item.itemType = itemType
+	}
+	return item
+}
+
+// applyDelta appends a delta notification's text; part is what follows the
+// item type in the method (`delta`, `outputDelta`, `summaryTextDelta`, ...).
+func (i *itemState) applyDelta(part, delta string, summaryIndex, contentIndex int) {
+	if i.size+len(delta) > maxItemDeltaBytes {
+		i.truncated = true
+		return
+	}
+	i.size += len(delta)
+	switch part {
+	case "outputDelta":
+		i.output = append(i.output, delta...)
+	case "summaryTextDelta", "summaryPartAdded":
+		i.summary = appendPart(i.summary, summaryIndex, delta)
+	case "textDelta":
+		i.content = appendPart(i.content, contentIndex, delta)
+	default:
+		i.text = append(i.text, delta...)
+	}
+}
+
+func appendPart(parts [][]byte, index int, delta string) [][]byte {
+	if index < 0 || index >= maxItemParts {
+		return parts
+	}
+	for len(parts) <= index {
+		parts = append(parts, nil)
+	}
+	parts[index] = append(parts[index], delta...)
+	return parts
+}
+
+// get returns one thread's state.
+func (r *threadStates) get(id string) (ThreadState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.threads[id]
+	if t == nil {
+		return ThreadState{ThreadID: id, EventID: r.eventID}, false
+	}
+	return t.view(r.eventID), true
+}
+
+// all returns every thread's state, most recently updated first.
+func (r *threadStates) all() []ThreadState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	threads := make([]*threadState, 0, len(r.threads))
+	for _, t := range r.threads {
+		threads = append(threads, t)
+	}
+	slices.SortFunc(threads, func(a, b *threadState) int {
+		return cmp.Compare(b.updated, a.updated)
+	})
+	out := make([]ThreadState, 0, len(threads))
+	for _, t := range threads {
+		out = append(out, t.view(r.eventID))
+	}
+	return out
+}
+
+func (t *threadState) view(eventID uint64) ThreadState {
+	out := ThreadState{
+		ThreadID:   t.id,
+		EventID:    eventID,
+		Thread:     t.thread,
+		TokenUsage: t.tokenUsage,
+	}
+	if t.turn != nil {
+		turn := &TurnState{
+			ID:     t.turn.id,
+			Status: t.turn.status,
+			Turn:   t.turn.turn,
+			Plan:   t.turn.plan,
+			Diff:   t.turn.diff,
+			Items:  make([]ItemState, 0, len(t.turn.items)),
+		}
+		for _, item := range t.turn.items {
+			turn.Items = append(turn.Items, item.view())
+		}
+		out.Turn = turn
+	}
+	return out
+}
+
+func (i *itemState) view() ItemState {
+	return ItemState{
+		ID:        i.id,
+		Type:      i.itemType,
+		Status:    i.status,
+		Item:      i.item,
+		Text:      string(i.text),
+		Output:    string(i.output),
+		Summary:   partStrings(i.summary),
+		Content:   partStrings(i.content),
+		Truncated: i.truncated,
+	}
+}
+
+func partStrings(parts [][]byte) []string {
+	if len(parts) == 0 {
+		return nil
+	}
+	out := make([]string, len(parts))
+	for i, part := range parts {
+		out[i] = string(part)
+	}
+	return out
+}
+
+// ThreadState returns the materialized state of one of the client's
+// threads, or false if the bridge has seen no notification about it.
+func (m *Manager) ThreadState(clientKey, threadID string) (ThreadState, bool) {
+	m.mu.Lock()
+	entry := m.sessions[strings.TrimSpace(clientKey)]
+	m.mu.Unlock()
+	if entry == nil {
+		return ThreadState{ThreadID: threadID}, false
+	}
+
+	state, ok := entry.threads.get(threadID)
+	state.Epoch = entry.hub.Epoch()
+	var pending []ServerRequest
+	entry.mu.Lock()
+	if entry.session != nil && !entry.session.Dead() {
+		pending = entry.session.PendingRequests()
+	}
+	entry.mu.Unlock()
+	state.PendingApprovals = approvalsFor(pending, &state)
+	return state, ok
+}
+
+// approvalsFor picks the pending requests for state's thread that it
+// already accounts for.
+func approvalsFor(pending []ServerRequest, state *ThreadState) []ServerRequest {
+	out := []ServerRequest{}
+	for _, req := range pending {
+		if req.ThreadID == state.ThreadID && req.EventID <= state.EventID {
+			out = append(out, req)
+		}
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package codex
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// turnTracker follows which turns are in flight, keyed by turn id, from the
+// `turn/start` response and `turn/started` / `turn/completed` notifications.
+type turnTracker struct {
+	mu    sync.Mutex
+	turns map[string]string
+}
+
+type activeTurn struct {
+	ThreadID string `json:"threadId"`
+	TurnID   string `json:"turnId"`
+}
+
+type turnPayload struct {
+	ThreadID string `json:"threadId"`
+	Turn     struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	} `json:"turn"`
+}
+
+func (t *turnTracker) observeNotification(msg rpcMessage) {
+	switch msg.Method {
+	case "turn/started", "turn/completed":
+	default:
+		return
+	}
+	var params turnPayload
+	if err := json.Unmarshal(msg.Params, &params); err != nil || params.Turn.ID == "" {
+		return
+	}
+	if msg.Method == "turn/completed" {
+		t.remove(params.Turn.ID)
+		return
+	}
+	t.add(params.Turn.ID, params.ThreadID)
+}
+
+func (t *turnTracker) observeResponse(method string, params any, resp []byte) {
+	if method != "turn/start" {
+		return
+	}
+	var decoded struct {
+		Result turnPayload `json:"result"`
+	}
+	if err := json.Unmarshal(resp, &decoded); err != nil || decoded.Result.Turn.ID == "" {
+		return
+	}
+	if status := decoded.Result.Turn.Status; status != "" && status != "inProgress" {
+		return
+	}
+	var threadID string
+	if fields, ok := params.(map[string]any); ok {
+		threadID, _ = fields["threadId"].(string)
+	}
+	t.add(decoded.Result.Turn.ID, threadID)
+}
+
+func (t *turnTracker) add(turnID, threadID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.turns == nil {
+		t.turns = make(map[string]string)
+	}
+	if threadID == "" {
+		threadID = t.turns[turnID]
+	}
+	t.turns[turnID] = threadID
+}
+
+func (t *turnTracker) remove(turnID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.turns, turnID)
+}
+
+func (t *turnTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.turns)
+}
+
+func (t *turnTracker) active() []activeTurn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]activeTurn, 0, len(t.turns))
+	for turnID, threadID := range t.turns {
+		out = append(out, activeTurn{ThreadID: threadID, TurnID: turnID})
+	}
+	return out
+}
@@ -5,7 +5,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"climate/server/internal/policy"
 	"github.com/spf13/viper"
 )
 
@@ -16,6 +18,41 @@ type Config struct {
 	TSAuthKey  string `mapstructure:"ts_auth_key"`
 	TSHostname string `mapstructure:"ts_hostname"`
 	TSStateDir string `mapstructure:"ts_state_dir"`
+
+	StopGrace    time.Duration `mapstructure:"stop_grace"`
+	CgroupParent string        `mapstructure:"cgroup_parent"`
+	// WSOriginPatterns are the browser origins, besides the server's own,
+	// allowed to open /ws.
+	WSOriginPatterns []string `mapstructure:"ws_origin_patterns"`
+
+	Session    SessionConfig    `mapstructure:"session"`
+	EventStore EventStoreConfig `mapstructure:"event_store"`
+
+	Policy policy.Config `mapstructure:"policy"`
+}
+
+// SessionConfig sizes the codex bridge; zero values keep the built-in defaults.
+type SessionConfig struct {
+	MaxSessions     int                      `mapstructure:"max_sessions"`
+	IdleTTL         time.Duration            `mapstructure:"idle_ttl"`
+	RPCTimeout      time.Duration            `mapstructure:"rpc_timeout"`
+	MethodTimeouts  map[string]time.Duration `mapstructure:"method_timeouts"`
+	HubCapacity     int                      `mapstructure:"hub_capacity"`
+	JanitorInterval time.Duration            `mapstructure:"janitor_interval"`
+	MaxBodyBytes    int64                    `mapstructure:"max_body_bytes"`
+	IdempotencyTTL  time.Duration            `mapstructure:"idempotency_ttl"`
+	ElideBytes      int                      `mapstructure:"elide_bytes"`
+	MaxLineBytes    int                      `mapstructure:"max_line_bytes"`
+}
+
+// EventStoreConfig enables the on-disk event log; zero values keep the
+// built-in defaults.
+type EventStoreConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Dir          string        `mapstructure:"dir"`
+	MaxBytes     int64         `mapstructure:"max_bytes"`
+	MaxAge       time.Duration `mapstructure:"max_age"`
+	SegmentBytes int64         `mapstructure:"segment_bytes"`
 }
 
 type Result struct {
@@ -1,21 +1,148 @@
 package events
 
-import "sync"
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Kind classifies what an event carries.
+type Kind string
+
+const (
+	// KindResponse is codex's answer to a client request.
+	KindResponse Kind = "response"
+	// KindNotification is a codex notification.
+	KindNotification Kind = "notification"
+	// KindServerRequest is a codex-initiated request awaiting a client answer.
+	KindServerRequest Kind = "serverRequest"
+	// KindBridge is an event generated by the bridge itself.
+	KindBridge Kind = "bridge"
+)
 
 type Event struct {
-	ID   uint64 `json:"id"`
-	Type string `json:"type,omitempty"`
-	Data string `json:"data"`
+	ID   uint64          `json:"id"`
+	Type string          `json:"type,omitempty"`
+	Kind Kind            `json:"kind,omitempty"`
+	Data json.RawMessage `json:"data"`
+
+	// ThreadID and Method say which thread and JSON-RPC method the event is
+	// about, when known, so subscribers can filter without parsing Data.
+	ThreadID string `json:"threadId,omitempty"`
+	Method   string `json:"method,omitempty"`
+	// ItemID is the thread item the event is about, if any; it ties deltas
+	// to the item/completed that supersedes them.
+	ItemID string `json:"itemId,omitempty"`
+	// Elided, if set, is Data with its large strings replaced by blob
+	// references, for the streams that opted into them; Data stays whole.
+	Elided json.RawMessage `json:"elided,omitempty"`
 }
 
+// Hub is a per-client event log: a fixed-size circular buffer of the most
+// recent events plus cursor-based subscribers. Publishing is O(1) whatever
+// the capacity and number of subscribers; each subscriber copies events out
+// of the log on its own goroutine and is woken through a shared notify
+// channel.
+//
+// High-priority events (see Priority) evicted from the ring move to a second
+// log of the same capacity, so a client reconnecting after a burst of output
+// still replays every turn, completed item and server request, and deltas
+// superseded by their item/completed are skipped on replay.
 type Hub struct {
 	mu       sync.RWMutex
-	subs     map[chan Event]struct{}
+	subs     map[*subscriber]struct{}
 	closed   bool
 	capacity int
 
+	// ring holds event id n at ring[(n-1)%capacity]; ids nextID-len+1 through
+	// nextID are retained.
+	ring   []Event
+	len    int
 	nextID uint64
-	buf    []Event
+	// evicted records, per thread, the id of the newest event that fell out
+	// of the ring, so gaps can name the threads they affect. Once it holds
+	// more than pruneAt threads, records of events older than anything
+	// still held are dropped (see pruneEvicted).
+	evicted map[string]uint64
+	pruneAt int
+
+	// retained holds high-priority events evicted from the ring, oldest
+	// first; retainDropped is the newest id that fell out of it.
+	retained      []Event
+	retainDropped uint64
+	// completed maps item ids to the id of their item/completed event.
+	completed map[string]uint64
+
+	// wake is closed (and replaced) by Publish when a subscriber is waiting.
+	wake    chan struct{}
+	waiters bool
+	// done is closed by Close.
+	done chan struct{}
+
+	// epoch identifies this event log; ids are only comparable within it.
+	epoch string
+	// store, if set, persists every event so subscribers can replay beyond
+	// the ring, and across restarts. Events reach it through writer, so
+	// Publish never waits on disk.
+	store  *Store
+	writer *storeWriter
+}
+
+// GapEventType is sent to a subscriber, outside the numbered stream, when it
+// cannot be given a contiguous stream. Clients should re-fetch the state of
+// the listed threads (e.g. with thread/read).
+const GapEventType = "session/gap"
+
+// Gap reasons.
+const (
+	// GapEvicted: the requested events are older than the oldest retained one.
+	GapEvicted = "evicted"
+	// GapReset: the requested id is newer than anything this hub published,
+	// i.e. the ids were reset (the server restarted).
+	GapReset = "reset"
+	// GapOverflow: the subscriber fell so far behind that events it had not
+	// read yet were evicted. It is disconnected, and may reconnect with
+	// Last-Event-ID to get what is still retained.
+	GapOverflow = "overflow"
+)
+
+// Gap describes the range of events a subscriber missed.
+type Gap struct {
+	Reason string `json:"reason"`
+	From   uint64 `json:"from"`
+	To     uint64 `json:"to"`
+	// ThreadIDs are the threads that lost events in the range. Threads whose
+	// last lost event is older than anything the hub still holds may be
+	// missing once many threads have been seen.
+	ThreadIDs []string `json:"threadIds"`
+	// Retained is set when only lower-priority events were lost: every
+	// lifecycle event, completed item and server request in the range is
+	// replayed right after the gap.
+	Retained bool `json:"retained,omitempty"`
+}
+
+// subscriberBuffer is how many events may sit in a subscriber's channel; the
+// log itself is the real buffer.
+const subscriberBuffer = 16
+
+// replayBatch bounds how many events a subscriber copies per lock.
+const replayBatch = 64
+
+type subscriber struct {
+	ch   chan Event
+	done chan struct{}
+	// cursor is the id of the next event to read from the ring.
+	cursor atomic.Uint64
+	// retainedTo, if set, is the end of a gap whose retained events are
+	// replayed from the retained log. It is fixed at subscription.
+	retainedTo uint64
 }
 
 func NewHub(capacity int) *Hub {
@@ -23,72 +150,416 @@ func NewHub(capacity int) *Hub {
 		capacity = 256
 	}
 	return &Hub{
-		subs:     make(map[chan Event]struct{}),
-		capacity: capacity,
-		buf:      make([]Event, 0, capacity),
+		subs:      make(map[*subscriber]struct{}),
+		capacity:  capacity,
+		ring:      make([]Event, capacity),
+		evicted:   make(map[string]uint64),
+		pruneAt:   capacity,
+		completed: make(map[string]uint64),
+		wake:      make(chan struct{}),
+		done:      make(chan struct{}),
+		epoch:     NewEpoch(),
 	}
 }
 
+// NewHubWithStore returns a hub backed by store: it continues the store's ids
+// and epoch, starts with its newest events in the ring, and appends every
+// published event to it. The hub owns the store and closes it on Close.
+func NewHubWithStore(capacity int, store *Store) (*Hub, error) {
+	h := NewHub(capacity)
+	h.store = store
+	h.writer = newStoreWriter(store)
+	h.epoch = store.Epoch()
+	tail, err := store.Tail(h.capacity)
+	if err != nil {
+		return nil, fmt.Errorf("load events from %s: %w", store.dir, err)
+	}
+	for _, evt := range tail {
+		h.ring[h.slot(evt.ID)] = evt
+		if evt.Method == ItemCompletedMethod && evt.ItemID != "" {
+			h.completed[evt.ItemID] = evt.ID
+		}
+	}
+	h.len = len(tail)
+	h.nextID = store.LastID()
+	// Nothing older than the ring was retained by this process.
+	h.retainDropped = h.oldestID() - 1
+	return h, nil
+}
+
+// Epoch identifies this hub's event log. It changes when ids restart, e.g.
+// when the server restarts without a durable store.
+func (h *Hub) Epoch() string {
+	return h.epoch
+}
+
 func (h *Hub) HighWaterMark() uint64 {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	if h.nextID == 0 {
-		return 0
-	}
 	return h.nextID
 }
 
+// Subscribers returns the number of live subscriptions that are keeping up,
+// i.e. have not yet lost events to retention.
+func (h *Hub) Subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	oldest := h.firstRetained()
+	n := 0
+	for sub := range h.subs {
+		if cursor := sub.cursor.Load(); cursor >= oldest || cursor <= sub.retainedTo {
+			n++
+		}
+	}
+	return n
+}
+
+// SubscribeFrom streams every event after lastEventID that is still
+// retained, then new events as they are published. If that cannot be done
+// contiguously the stream starts with (or, for slow subscribers, ends with) a
+// GapEventType event. The returned func unsubscribes and closes the channel.
 func (h *Hub) SubscribeFrom(lastEventID uint64) (<-chan Event, func()) {
+	return h.Resume(Position{ID: lastEventID})
+}
+
+// Resume is SubscribeFrom for a position that may come from another epoch:
+// if pos.Epoch is set and differs from the hub's, the ids are unrelated and
+// the stream starts with a GapReset.
+func (h *Hub) Resume(pos Position) (<-chan Event, func()) {
+	lastEventID := pos.ID
+	if pos.Epoch != "" && pos.Epoch != h.epoch && lastEventID > 0 {
+		// Force a reset: no id in this log can be trusted to match.
+		lastEventID = max(lastEventID, h.HighWaterMark()+1)
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	ch := make(chan Event, h.capacity+16)
+	sub := &subscriber{
+		ch:   make(chan Event, subscriberBuffer),
+		done: make(chan struct{}),
+	}
 	if h.closed {
-		close(ch)
-		return ch, func() {}
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+
+	gap, hasGap := h.replayGap(lastEventID)
+	switch {
+	case lastEventID == 0 || hasGap && gap.Reason == GapReset:
+		sub.cursor.Store(h.oldestID())
+	case hasGap:
+		sub.cursor.Store(gap.From)
+		sub.retainedTo = gap.To
+	default:
+		sub.cursor.Store(lastEventID + 1)
+	}
+	h.subs[sub] = struct{}{}
+
+	var first *Event
+	if hasGap {
+		evt := gapEvent(gap)
+		first = &evt
+	}
+	go h.deliver(sub, first)
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, sub)
+			h.mu.Unlock()
+			close(sub.done)
+		})
 	}
+}
 
-	// Replay buffered events first (contiguous ordering).
-	for _, evt := range h.buf {
-		if evt.ID > lastEventID {
-			ch <- evt
+// deliver copies events from the ring into sub.ch until the subscriber
+// unsubscribes, the hub closes, or the subscriber falls behind the ring.
+func (h *Hub) deliver(sub *subscriber, first *Event) {
+	defer close(sub.ch)
+
+	if first != nil && !h.send(sub, *first) {
+		return
+	}
+	buf := make([]Event, 0, replayBatch)
+	for {
+		batch, gap, wake, ok := h.read(sub, buf[:0])
+		if !ok {
+			return
+		}
+		if gap != nil {
+			h.send(sub, gapEvent(*gap))
+			return
+		}
+		if wake != nil {
+			select {
+			case <-wake:
+			case <-sub.done:
+				return
+			}
+			continue
+		}
+		for _, evt := range batch {
+			if !h.send(sub, evt) {
+				return
+			}
 		}
 	}
+}
 
-	h.subs[ch] = struct{}{}
-	return ch, func() {
-		h.mu.Lock()
-		defer h.mu.Unlock()
-		if _, ok := h.subs[ch]; ok {
-			delete(h.subs, ch)
-			close(ch)
+// read copies the next events at sub's cursor into batch. When there are none
+// it returns a channel that is closed on the next Publish; when the
+// subscriber has fallen out of the ring it unsubscribes it and returns the gap.
+func (h *Hub) read(sub *subscriber, batch []Event) ([]Event, *Gap, <-chan struct{}, bool) {
+	h.mu.RLock()
+	if _, ok := h.subs[sub]; !ok || h.closed {
+		h.mu.RUnlock()
+		return nil, nil, nil, false
+	}
+	cursor := sub.cursor.Load()
+	if cursor <= sub.retainedTo {
+		batch = h.readRetained(sub, cursor, batch)
+		h.mu.RUnlock()
+		return batch, nil, nil, true
+	}
+	if cursor < h.oldestID() && h.store != nil {
+		h.mu.RUnlock()
+		return h.readStore(sub, cursor, batch)
+	}
+	if cursor >= h.oldestID() && cursor <= h.nextID {
+		id := cursor
+		for ; id <= h.nextID && len(batch) < replayBatch; id++ {
+			if evt := h.ring[h.slot(id)]; !h.superseded(evt) {
+				batch = append(batch, evt)
+			}
 		}
+		sub.cursor.Store(id)
+		h.mu.RUnlock()
+		return batch, nil, nil, true
 	}
+	h.mu.RUnlock()
+
+	// Caught up or overflowed: both need the write lock.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; !ok || h.closed {
+		return nil, nil, nil, false
+	}
+	if cursor < h.oldestID() {
+		if h.store != nil {
+			// The ring moved on in between; read from disk.
+			return batch, nil, nil, true
+		}
+		gap := h.evictedGap(GapOverflow, cursor)
+		delete(h.subs, sub)
+		return nil, &gap, nil, true
+	}
+	if cursor <= h.nextID {
+		// Published in between; read again.
+		return batch, nil, nil, true
+	}
+	h.waiters = true
+	return nil, nil, h.wake, true
 }
 
-func (h *Hub) Publish(evt Event) {
+// readRetained copies the retained events in [cursor, sub.retainedTo] into
+// batch and moves the cursor past them.
+func (h *Hub) readRetained(sub *subscriber, cursor uint64, batch []Event) []Event {
+	i, _ := slices.BinarySearchFunc(h.retained, cursor, func(evt Event, id uint64) int {
+		return cmp.Compare(evt.ID, id)
+	})
+	for ; i < len(h.retained) && h.retained[i].ID <= sub.retainedTo && len(batch) < replayBatch; i++ {
+		batch = append(batch, h.retained[i])
+	}
+	next := sub.retainedTo + 1
+	if len(batch) == replayBatch {
+		next = batch[len(batch)-1].ID + 1
+	}
+	sub.cursor.Store(next)
+	return batch
+}
+
+// readStore serves a subscriber that is behind the ring from the store (or
+// the events still queued for it), without holding the hub lock during disk
+// reads.
+func (h *Hub) readStore(sub *subscriber, cursor uint64, batch []Event) ([]Event, *Gap, <-chan struct{}, bool) {
+	// Queued first: an event no longer queued has been written.
+	events := h.writer.queuedFrom(cursor, replayBatch)
+	var err error
+	if len(events) == 0 {
+		events, err = h.store.ReadFrom(cursor-1, replayBatch)
+	}
+	if err == nil && len(events) > 0 && events[0].ID == cursor {
+		h.mu.RLock()
+		for _, evt := range events {
+			if !h.superseded(evt) {
+				batch = append(batch, evt)
+			}
+		}
+		h.mu.RUnlock()
+		sub.cursor.Store(events[len(events)-1].ID + 1)
+		return batch, nil, nil, true
+	}
+	if err != nil && !errors.Is(err, ErrEvicted) {
+		log.Printf("[events] replay from %s failed: %v", h.store.dir, err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; !ok || h.closed {
+		return nil, nil, nil, false
+	}
+	if cursor >= h.oldestID() {
+		// Back within the ring.
+		return batch, nil, nil, true
+	}
+	gap := h.evictedGap(GapOverflow, cursor)
+	delete(h.subs, sub)
+	return nil, &gap, nil, true
+}
+
+func (h *Hub) send(sub *subscriber, evt Event) bool {
+	select {
+	case sub.ch <- evt:
+		return true
+	case <-sub.done:
+		return false
+	case <-h.done:
+		return false
+	}
+}
+
+// Publish appends evt to the ring and wakes subscribers, returning the id
+// assigned to it (0 if the hub is closed).
+func (h *Hub) Publish(evt Event) uint64 {
+	if h.writer != nil {
+		// Wait for room in the store's queue before taking the lock, so a
+		// slow disk holds up publishers but not readers.
+		h.writer.reserve()
+	}
 	h.mu.Lock()
+	defer h.mu.Unlock()
 	if h.closed {
-		h.mu.Unlock()
-		return
+		if h.writer != nil {
+			h.writer.release()
+		}
+		return 0
 	}
 	h.nextID++
 	evt.ID = h.nextID
 
-	if len(h.buf) < h.capacity {
-		h.buf = append(h.buf, evt)
-	} else if h.capacity > 0 {
-		copy(h.buf, h.buf[1:])
-		h.buf[h.capacity-1] = evt
+	slot := h.slot(evt.ID)
+	if h.len == h.capacity {
+		if old := h.ring[slot]; old.Priority() == PriorityHigh {
+			h.retain(old)
+		} else {
+			h.forget(old)
+		}
+	} else {
+		h.len++
+	}
+	h.ring[slot] = evt
+	if evt.Method == ItemCompletedMethod && evt.ItemID != "" {
+		h.completed[evt.ItemID] = evt.ID
+	}
+
+	if h.writer != nil {
+		// Queued under the lock, so the store sees events in id order.
+		h.writer.enqueue(evt)
 	}
 
-	for ch := range h.subs {
-		select {
-		case ch <- evt:
-		default:
+	if h.waiters {
+		close(h.wake)
+		h.wake = make(chan struct{})
+		h.waiters = false
+	}
+	return evt.ID
+}
+
+func (h *Hub) slot(id uint64) int {
+	return int((id - 1) % uint64(h.capacity))
+}
+
+// oldestID is the id of the oldest event in the ring (nextID+1 when empty).
+func (h *Hub) oldestID() uint64 {
+	return h.nextID - uint64(h.len) + 1
+}
+
+// oldestHeld is the id of the oldest event still in the ring, the retained
+// log or the store.
+func (h *Hub) oldestHeld() uint64 {
+	oldest := h.firstRetained()
+	if len(h.retained) > 0 {
+		oldest = min(oldest, h.retained[0].ID)
+	}
+	return oldest
+}
+
+// firstRetained is the id of the oldest event that can still be replayed,
+// from the ring or the store.
+func (h *Hub) firstRetained() uint64 {
+	oldest := h.oldestID()
+	if h.store != nil {
+		if first := h.store.FirstID(); first > 0 && first < oldest {
+			return first
+		}
+	}
+	return oldest
+}
+
+// replayGap reports whether replaying from lastEventID would skip events.
+func (h *Hub) replayGap(lastEventID uint64) (Gap, bool) {
+	if lastEventID == 0 {
+		return Gap{}, false
+	}
+	if lastEventID > h.nextID {
+		threads := make(map[string]bool)
+		for id := h.oldestID(); id <= h.nextID; id++ {
+			if threadID := h.ring[h.slot(id)].ThreadID; threadID != "" {
+				threads[threadID] = true
+			}
 		}
+		for threadID := range h.evicted {
+			threads[threadID] = true
+		}
+		return Gap{Reason: GapReset, From: 1, To: h.nextID, ThreadIDs: sortedThreads(threads)}, true
+	}
+	if h.len == 0 || lastEventID+1 >= h.firstRetained() {
+		return Gap{}, false
+	}
+	gap := h.evictedGap(GapEvicted, lastEventID+1)
+	gap.Retained = h.retainDropped < gap.From
+	return gap, true
+}
+
+func (h *Hub) evictedGap(reason string, from uint64) Gap {
+	gap := Gap{Reason: reason, From: from, To: h.firstRetained() - 1}
+	threads := make(map[string]bool)
+	for threadID, newest := range h.evicted {
+		// Evicted from the ring after From: the thread may have lost an
+		// event in range (exactly so without a store, where To is the last
+		// evicted id).
+		if newest >= gap.From {
+			threads[threadID] = true
+		}
+	}
+	gap.ThreadIDs = sortedThreads(threads)
+	return gap
+}
+
+func gapEvent(gap Gap) Event {
+	data, _ := json.Marshal(gap)
+	return Event{Type: GapEventType, Kind: KindBridge, Data: data}
+}
+
+func sortedThreads(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for threadID := range set {
+		out = append(out, threadID)
 	}
-	h.mu.Unlock()
+	slices.Sort(out)
+	return out
 }
 
 func (h *Hub) Close() {
@@ -98,9 +569,42 @@ func (h *Hub) Close() {
 		return
 	}
 	h.closed = true
-	for ch := range h.subs {
-		close(ch)
-	}
 	h.subs = nil
-	h.buf = nil
+	h.ring = nil
+	h.len = 0
+	h.retained = nil
+	h.completed = nil
+	close(h.wake)
+	close(h.done)
+	if h.writer != nil {
+		h.writer.close()
+	}
+}
+
+// Position is where a subscriber resumes: the epoch of the log it was
+// reading and the last id it saw. Its string form, used as the SSE id, is
+// "<epoch>-<id>"; a bare "<id>" is accepted for clients that predate epochs.
+type Position struct {
+	Epoch string
+	ID    uint64
+}
+
+func (p Position) String() string {
+	if p.Epoch == "" {
+		return strconv.FormatUint(p.ID, 10)
+	}
+	return p.Epoch + "-" + strconv.FormatUint(p.ID, 10)
+}
+
+func ParsePosition(value string) (Position, error) {
+	value = strings.TrimSpace(value)
+	epoch, id, found := strings.Cut(value, "-")
+	if !found {
+		epoch, id = "", value
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return Position{}, fmt.Errorf("invalid event position %q", value)
+	}
+	return Position{Epoch: epoch, ID: n}, nil
 }
@@ -0,0 +1,55 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// BenchmarkPublish shows that publishing costs the same whatever the ring
+// capacity and however many subscribers are attached.
+func BenchmarkPublish(b *testing.B) {
+	data := json.RawMessage(`{"method":"item/agentMessage/delta","params":{"threadId":"thr_1","delta":"hello"}}`)
+	for _, capacity := range []int{256, 1024, 16384} {
+		for _, subscribers := range []int{0, 1, 8} {
+			b.Run(fmt.Sprintf("capacity=%d/subscribers=%d", capacity, subscribers), func(b *testing.B) {
+				h := NewHub(capacity)
+				defer h.Close()
+				for range subscribers {
+					ch, cancel := h.SubscribeFrom(0)
+					defer cancel()
+					go func() {
+						for range ch {
+						}
+					}()
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for range b.N {
+					h.Publish(Event{Type: "codex/stdout", Kind: KindNotification, Data: data, ThreadID: "thr_1"})
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkReplay measures a reconnecting subscriber catching up on a full ring.
+func BenchmarkReplay(b *testing.B) {
+	data := json.RawMessage(`{"method":"item/agentMessage/delta"}`)
+	h := NewHub(1024)
+	defer h.Close()
+	for range 1024 {
+		h.Publish(Event{Type: "codex/stdout", Data: data})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		ch, cancel := h.SubscribeFrom(h.HighWaterMark() - 1024)
+		for range 1024 {
+			<-ch
+		}
+		cancel()
+	}
+}
@@ -1,15 +1,17 @@
 package events
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 )
 
 func TestHubReplaySubscribeFrom(t *testing.T) {
 	h := NewHub(16)
-	h.Publish(Event{Type: "t", Data: "a"})
-	h.Publish(Event{Type: "t", Data: "b"})
-	h.Publish(Event{Type: "t", Data: "c"})
+	h.Publish(Event{Type: "t", Data: json.RawMessage("a")})
+	h.Publish(Event{Type: "t", Data: json.RawMessage("b")})
+	h.Publish(Event{Type: "t", Data: json.RawMessage("c")})
 
 	ch, cancel := h.SubscribeFrom(1)
 	defer cancel()
@@ -18,7 +20,7 @@ func TestHubReplaySubscribeFrom(t *testing.T) {
 	for i := range want {
 		select {
 		case evt := <-ch:
-			if evt.Data != want[i] {
+			if string(evt.Data) != want[i] {
 				t.Fatalf("event %d: got %q, want %q", i, evt.Data, want[i])
 			}
 		case <-time.After(500 * time.Millisecond):
@@ -32,9 +34,202 @@ func TestHubHighWaterMark(t *testing.T) {
 	if got := h.HighWaterMark(); got != 0 {
 		t.Fatalf("got %d, want 0", got)
 	}
-	h.Publish(Event{Type: "t", Data: "x"})
-	h.Publish(Event{Type: "t", Data: "y"})
+	h.Publish(Event{Type: "t", Data: json.RawMessage("x")})
+	h.Publish(Event{Type: "t", Data: json.RawMessage("y")})
 	if got := h.HighWaterMark(); got != 2 {
 		t.Fatalf("got %d, want 2", got)
 	}
 }
+
+func TestHubSubscribeFromEvictedIDEmitsGap(t *testing.T) {
+	h := NewHub(2)
+	h.Publish(Event{Type: "t", Data: json.RawMessage("a"), ThreadID: "thr_1"})
+	h.Publish(Event{Type: "t", Data: json.RawMessage("b"), ThreadID: "thr_2"})
+	h.Publish(Event{Type: "t", Data: json.RawMessage("c"), ThreadID: "thr_3"})
+	h.Publish(Event{Type: "t", Data: json.RawMessage("d")})
+
+	ch, cancel := h.SubscribeFrom(1)
+	defer cancel()
+
+	evt := <-ch
+	if evt.Type != GapEventType {
+		t.Fatalf("got %q, want %q", evt.Type, GapEventType)
+	}
+	var gap Gap
+	if err := json.Unmarshal(evt.Data, &gap); err != nil {
+		t.Fatalf("decode gap: %v", err)
+	}
+	if gap.Reason != GapEvicted || gap.From != 2 || gap.To != 2 || len(gap.ThreadIDs) != 1 || gap.ThreadIDs[0] != "thr_2" {
+		t.Fatalf("unexpected gap: %+v", gap)
+	}
+	if evt := <-ch; string(evt.Data) != "c" {
+		t.Fatalf("replay resumed at %q, want c", evt.Data)
+	}
+}
+
+func TestHubSubscribeFromUnknownIDResetsStream(t *testing.T) {
+	h := NewHub(4)
+	h.Publish(Event{Type: "t", Data: json.RawMessage("a")})
+
+	ch, cancel := h.SubscribeFrom(99)
+	defer cancel()
+
+	var gap Gap
+	if evt := <-ch; evt.Type != GapEventType || json.Unmarshal(evt.Data, &gap) != nil || gap.Reason != GapReset {
+		t.Fatalf("expected reset gap, got %+v", evt)
+	}
+	if evt := <-ch; string(evt.Data) != "a" {
+		t.Fatalf("got %q, want full replay", evt.Data)
+	}
+}
+
+func TestHubDisconnectsSlowSubscriberWithGap(t *testing.T) {
+	h := NewHub(1)
+	ch, cancel := h.SubscribeFrom(0)
+	defer cancel()
+
+	for i := 0; i < 100; i++ {
+		h.Publish(Event{Type: "t", Data: json.RawMessage("x"), ThreadID: "thr_1"})
+	}
+	if n := h.Subscribers(); n != 0 {
+		t.Fatalf("slow subscriber still attached (%d)", n)
+	}
+
+	var last Event
+	for evt := range ch {
+		last = evt
+	}
+	var gap Gap
+	if last.Type != GapEventType || json.Unmarshal(last.Data, &gap) != nil {
+		t.Fatalf("stream did not end with a gap: %+v", last)
+	}
+	if gap.Reason != GapOverflow || gap.From == 0 || len(gap.ThreadIDs) != 1 {
+		t.Fatalf("unexpected gap: %+v", gap)
+	}
+}
+
+func TestHubSubscriberReceivesLiveEventsInOrder(t *testing.T) {
+	h := NewHub(8)
+	ch, cancel := h.SubscribeFrom(0)
+	defer cancel()
+
+	// More than the ring holds, read as they come: a subscriber that keeps
+	// up never sees a gap.
+	const n = 100
+	go func() {
+		for i := 0; i < n; i++ {
+			h.Publish(Event{Type: "t", Data: json.RawMessage("x")})
+			time.Sleep(time.Millisecond / 10)
+		}
+	}()
+	for want := uint64(1); want <= n; want++ {
+		select {
+		case evt := <-ch:
+			if evt.ID != want {
+				t.Fatalf("got event %d (%s), want %d", evt.ID, evt.Type, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for event %d", want)
+		}
+	}
+}
+
+func TestHubCloseEndsSubscriptions(t *testing.T) {
+	h := NewHub(4)
+	ch, cancel := h.SubscribeFrom(0)
+	defer cancel()
+	h.Close()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("expected closed channel")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("subscription not closed by Close")
+	}
+}
+
+func TestHubRetainsHighPriorityEventsPastTheRing(t *testing.T) {
+	h := NewHub(4)
+	h.Publish(Event{Kind: KindNotification, Method: "turn/started", ThreadID: "thr_1", Data: json.RawMessage("start")})
+	h.Publish(Event{Kind: KindServerRequest, Method: "item/commandExecution/requestApproval", ThreadID: "thr_1", Data: json.RawMessage("ask")})
+	for i := 0; i < 10; i++ {
+		h.Publish(Event{Kind: KindNotification, Method: "item/commandExecution/outputDelta", ThreadID: "thr_1", ItemID: "item_1", Data: json.RawMessage("out")})
+	}
+	h.Publish(Event{Kind: KindNotification, Method: "item/completed", ThreadID: "thr_1", ItemID: "item_1", Data: json.RawMessage("done")})
+
+	ch, cancel := h.SubscribeFrom(1)
+	defer cancel()
+
+	var gap Gap
+	if evt := <-ch; evt.Type != GapEventType || json.Unmarshal(evt.Data, &gap) != nil {
+		t.Fatalf("expected gap, got %+v", evt)
+	}
+	if gap.Reason != GapEvicted || gap.From != 2 || gap.To != 9 || !gap.Retained {
+		t.Fatalf("unexpected gap: %+v", gap)
+	}
+	// The approval survives the burst of output; the deltas still in the ring
+	// are superseded by item/completed.
+	for _, want := range []string{"ask", "done"} {
+		select {
+		case evt := <-ch:
+			if string(evt.Data) != want {
+				t.Fatalf("got %d %q, want %q", evt.ID, evt.Data, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	// A fresh subscriber starts at the ring without a gap.
+	fresh, cancelFresh := h.SubscribeFrom(0)
+	defer cancelFresh()
+	if evt := <-fresh; evt.ID != 13 {
+		t.Fatalf("fresh subscriber started at %d (%s), want 13", evt.ID, evt.Type)
+	}
+}
+
+func TestHubGapIsNotRetainedOnceHighPriorityEventsAreDropped(t *testing.T) {
+	h := NewHub(1)
+	for i := 0; i < 4; i++ {
+		h.Publish(Event{Kind: KindNotification, Method: "turn/completed", Data: json.RawMessage("x")})
+	}
+
+	ch, cancel := h.SubscribeFrom(1)
+	defer cancel()
+	var gap Gap
+	if evt := <-ch; evt.Type != GapEventType || json.Unmarshal(evt.Data, &gap) != nil {
+		t.Fatalf("expected gap, got %+v", evt)
+	}
+	if gap.Retained || gap.From != 2 || gap.To != 3 {
+		t.Fatalf("unexpected gap: %+v", gap)
+	}
+	// Event 3 is still in the retained log.
+	if evt := <-ch; evt.ID != 3 {
+		t.Fatalf("got event %d, want 3", evt.ID)
+	}
+}
+
+func TestHubPrunesEvictionRecordsOfThreadsNoLongerHeld(t *testing.T) {
+	h := NewHub(4)
+	for i := range 1000 {
+		h.Publish(Event{Type: "t", ThreadID: fmt.Sprintf("thr_%d", i), Data: json.RawMessage("x")})
+	}
+	h.mu.RLock()
+	records := len(h.evicted)
+	h.mu.RUnlock()
+	if records > 2*h.capacity {
+		t.Fatalf("%d eviction records kept for a ring of %d", records, h.capacity)
+	}
+
+	// The newest evicted thread is still named.
+	ch, cancel := h.SubscribeFrom(995)
+	defer cancel()
+	var gap Gap
+	if evt := <-ch; evt.Type != GapEventType || json.Unmarshal(evt.Data, &gap) != nil {
+		t.Fatalf("expected gap, got %+v", evt)
+	}
+	if gap.From != 996 || gap.To != 996 || len(gap.ThreadIDs) != 1 || gap.ThreadIDs[0] != "thr_995" {
+		t.Fatalf("unexpected gap: %+v", gap)
+	}
+}
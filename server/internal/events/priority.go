@@ -0,0 +1,105 @@
+package events
+
+import "strings"
+
+// Priority ranks events for retention: when the ring is full, high-priority
+// events are kept in a secondary log long after lower ones are dropped.
+type Priority int
+
+const (
+	// PriorityLow is streaming output (agent message, reasoning and command
+	// output deltas), superseded once the item completes.
+	PriorityLow Priority = iota
+	// PriorityNormal is everything without a more specific class.
+	PriorityNormal
+	// PriorityHigh is lifecycle events, completed items and server requests:
+	// what a client needs to reconstruct authoritative state.
+	PriorityHigh
+)
+
+// ItemCompletedMethod carries the final state of an item; deltas for the
+// same item published before it are dropped from replay.
+const ItemCompletedMethod = "item/completed"
+
+var lifecycleMethods = map[string]bool{
+	"thread/started":    true,
+	"turn/started":      true,
+	"turn/completed":    true,
+	"item/started":      true,
+	ItemCompletedMethod: true,
+	"error":             true,
+}
+
+func (e Event) Priority() Priority {
+	switch e.Kind {
+	case KindServerRequest:
+		return PriorityHigh
+	case KindNotification:
+		if lifecycleMethods[e.Method] {
+			return PriorityHigh
+		}
+		if isDelta(e.Method) {
+			return PriorityLow
+		}
+	case KindBridge:
+		// Session lifecycle and the outcome of server requests.
+		if strings.HasPrefix(e.Type, "session/") || e.Type == "approval/resolved" || e.Type == "policy/decision" {
+			return PriorityHigh
+		}
+	}
+	return PriorityNormal
+}
+
+// isDelta matches codex's streaming notifications: item/agentMessage/delta,
+// item/commandExecution/outputDelta, item/reasoning/textDelta and the like.
+func isDelta(method string) bool {
+	return strings.HasSuffix(method, "/delta") || strings.HasSuffix(method, "Delta")
+}
+
+// pruneEvicted drops the eviction records of threads whose newest evicted
+// event is older than anything still held, keeping h.evicted bounded by the
+// threads that can still be replayed. The next prune waits until the map
+// has doubled, so Publish stays O(1) amortized.
+func (h *Hub) pruneEvicted() {
+	oldest := h.oldestHeld()
+	for threadID, newest := range h.evicted {
+		if newest < oldest {
+			delete(h.evicted, threadID)
+		}
+	}
+	h.pruneAt = max(h.capacity, 2*len(h.evicted))
+}
+
+// superseded reports whether evt is a delta whose item has since completed.
+func (h *Hub) superseded(evt Event) bool {
+	if evt.ItemID == "" || evt.Kind != KindNotification || !isDelta(evt.Method) {
+		return false
+	}
+	completed, ok := h.completed[evt.ItemID]
+	return ok && completed > evt.ID
+}
+
+// retain moves a high-priority event evicted from the ring into the retained
+// log, dropping the oldest retained event if that is full.
+func (h *Hub) retain(evt Event) {
+	if len(h.retained) == h.capacity {
+		h.forget(h.retained[0])
+		h.retainDropped = h.retained[0].ID
+		h.retained[0] = Event{}
+		h.retained = h.retained[1:]
+	}
+	h.retained = append(h.retained, evt)
+}
+
+// forget records that evt is no longer held in memory.
+func (h *Hub) forget(evt Event) {
+	if evt.ThreadID != "" {
+		h.evicted[evt.ThreadID] = evt.ID
+		if len(h.evicted) > h.pruneAt {
+			h.pruneEvicted()
+		}
+	}
+	if evt.Method == ItemCompletedMethod && h.completed[evt.ItemID] == evt.ID {
+		delete(h.completed, evt.ItemID)
+	}
+}
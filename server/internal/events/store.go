@@ -0,0 +1,633 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStoreMaxBytes     = 64 << 20
+	defaultStoreMaxAge       = 7 * 24 * time.Hour
+	defaultStoreSegmentBytes = 4 << 20
+
+	epochFile     = "epoch"
+	segmentSuffix = ".log"
+
+	// storeIndexInterval is how many events apart a segment's sparse index
+	// records offsets, so reads seek close to where they start.
+	storeIndexInterval = 64
+)
+
+// ErrEvicted is returned by Store.ReadFrom when the requested events have
+// already been removed by retention.
+var ErrEvicted = errors.New("events no longer retained")
+
+// StoreConfig sizes an on-disk event store. Zero values fall back to the
+// defaults.
+type StoreConfig struct {
+	// MaxBytes caps the total size of the segment files.
+	MaxBytes int64
+	// MaxAge drops segments whose newest event is older than this. Retention
+	// is applied at startup and whenever a segment is rotated.
+	MaxAge time.Duration
+	// SegmentBytes is the size at which a new segment file is started.
+	SegmentBytes int64
+}
+
+// Store persists a hub's events as append-only segment files of one JSON
+// event per line, named after the first id they hold, so replay survives
+// server restarts. Its epoch identifies the log: ids are only comparable
+// within one epoch.
+type Store struct {
+	dir string
+	cfg StoreConfig
+
+	mu       sync.Mutex
+	epoch    string
+	segments []segment
+	file     *os.File
+	w        *bufio.Writer
+	lastID   uint64
+}
+
+type segment struct {
+	path    string
+	first   uint64
+	last    uint64
+	size    int64
+	modTime time.Time
+
+	// index holds the offset of every storeIndexInterval-th event; segments
+	// loaded at startup are indexed on first read.
+	index   []indexEntry
+	indexed bool
+}
+
+type indexEntry struct {
+	id     uint64
+	offset int64
+}
+
+// offsetFor returns where to start reading for events after `after`.
+func (seg segment) offsetFor(after uint64) int64 {
+	i, found := slices.BinarySearchFunc(seg.index, after+1, func(e indexEntry, id uint64) int {
+		return cmp.Compare(e.id, id)
+	})
+	if !found {
+		i--
+	}
+	if i < 0 {
+		return 0
+	}
+	return seg.index[i].offset
+}
+
+// OpenStore opens (or creates) the store in dir and applies retention.
+func OpenStore(dir string, cfg StoreConfig) (*Store, error) {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultStoreMaxBytes
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = defaultStoreMaxAge
+	}
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = defaultStoreSegmentBytes
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create event store %s: %w", dir, err)
+	}
+
+	s := &Store{dir: dir, cfg: cfg}
+	epoch, err := loadEpoch(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.epoch = epoch
+	if err := s.loadSegments(); err != nil {
+		return nil, err
+	}
+	s.applyRetention()
+	return s, nil
+}
+
+func loadEpoch(dir string) (string, error) {
+	path := filepath.Join(dir, epochFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if epoch := strings.TrimSpace(string(data)); epoch != "" {
+			return epoch, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("read event store epoch: %w", err)
+	}
+	epoch := NewEpoch()
+	if err := os.WriteFile(path, []byte(epoch+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("write event store epoch: %w", err)
+	}
+	return epoch, nil
+}
+
+// NewEpoch returns a random epoch for a new event log.
+func NewEpoch() string {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func (s *Store) loadSegments() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("read event store %s: %w", s.dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, segment{
+			path:    filepath.Join(s.dir, name),
+			first:   first,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	slices.SortFunc(s.segments, func(a, b segment) int {
+		return cmp.Compare(a.first, b.first)
+	})
+
+	// Ids are sequential, so a segment ends where the next one starts; only
+	// the newest has to be read to find the last id.
+	for i := range s.segments {
+		if i+1 < len(s.segments) {
+			s.segments[i].last = s.segments[i+1].first - 1
+		}
+	}
+	if n := len(s.segments); n > 0 {
+		seg := &s.segments[n-1]
+		last, size, index, err := scanSegment(seg.path, seg.first, -1)
+		if err != nil {
+			return fmt.Errorf("open event segment: %w", err)
+		}
+		seg.last, seg.size, seg.index, seg.indexed = last, size, index, true
+		s.lastID = max(last, seg.first-1)
+	}
+	return nil
+}
+
+// scanSegment reads up to limit bytes of a segment (all of it if negative)
+// and returns the id of the last complete event, the size of the complete
+// prefix and the segment's index. A torn final line from a crash is ignored
+// and later overwritten.
+func scanSegment(path string, first uint64, limit int64) (uint64, int64, []indexEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer f.Close()
+
+	var src io.Reader = f
+	if limit >= 0 {
+		src = io.LimitReader(f, limit)
+	}
+	var last uint64
+	var size int64
+	var index []indexEntry
+	r := bufio.NewReader(src)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		id, ok := lineID(line)
+		if !ok {
+			break
+		}
+		if (id-first)%storeIndexInterval == 0 {
+			index = append(index, indexEntry{id: id, offset: size})
+		}
+		last = id
+		size += int64(len(line))
+	}
+	return last, size, index, nil
+}
+
+// lineID reads the id of a stored event. Events are written with the id
+// first, so it is parsed from the prefix without decoding the rest.
+func lineID(line []byte) (uint64, bool) {
+	const prefix = `{"id":`
+	if rest, ok := bytes.CutPrefix(line, []byte(prefix)); ok {
+		end := bytes.IndexAny(rest, ",}")
+		if end > 0 {
+			if id, err := strconv.ParseUint(string(rest[:end]), 10, 64); err == nil {
+				return id, true
+			}
+		}
+	}
+	var evt Event
+	if json.Unmarshal(line, &evt) != nil {
+		return 0, false
+	}
+	return evt.ID, true
+}
+
+func (s *Store) Epoch() string {
+	return s.epoch
+}
+
+// LastID is the id of the newest stored event (0 if empty).
+func (s *Store) LastID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastID
+}
+
+// FirstID is the id of the oldest stored event (0 if empty).
+func (s *Store) FirstID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 || s.lastID == 0 {
+		return 0
+	}
+	return s.segments[0].first
+}
+
+// Append writes evt, whose id must be greater than the last stored one.
+// After a failed write the next event starts a fresh segment: the events
+// lost in between read as a gap. Appends must not run concurrently; the
+// write itself happens outside s.mu, so readers only see the event once it
+// is flushed and never wait for the disk.
+func (s *Store) Append(evt Event) error {
+	line, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	if evt.ID <= s.lastID {
+		s.mu.Unlock()
+		return fmt.Errorf("event %d does not follow %d", evt.ID, s.lastID)
+	}
+	n := len(s.segments)
+	if s.w == nil || s.segments[n-1].size >= s.cfg.SegmentBytes || s.segments[n-1].last+1 != evt.ID {
+		if err := s.rotate(evt.ID); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	w := s.w
+	s.mu.Unlock()
+
+	_, err = w.Write(line)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		// The writer keeps its error; drop it, and whatever part of the
+		// line reached the file, by rotating on the next append.
+		s.mu.Lock()
+		if s.w == w {
+			_ = s.file.Close()
+			s.file, s.w = nil, nil
+		}
+		s.mu.Unlock()
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg := &s.segments[len(s.segments)-1]
+	if seg.indexed && (evt.ID-seg.first)%storeIndexInterval == 0 {
+		seg.index = append(seg.index, indexEntry{id: evt.ID, offset: seg.size})
+	}
+	seg.size += int64(len(line))
+	seg.last = evt.ID
+	seg.modTime = time.Now()
+	s.lastID = evt.ID
+	return nil
+}
+
+// rotate opens the segment new events are appended to: the newest existing
+// one if firstID continues it (after a restart), or a fresh one starting at
+// firstID.
+func (s *Store) rotate(firstID uint64) error {
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file, s.w = nil, nil
+	}
+	if n := len(s.segments); n > 0 && s.segments[n-1].size < s.cfg.SegmentBytes && s.segments[n-1].last+1 == firstID {
+		seg := s.segments[n-1]
+		f, err := os.OpenFile(seg.path, os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("open event segment: %w", err)
+		}
+		// Drop a torn final line left by a crash.
+		err = f.Truncate(seg.size)
+		if err == nil {
+			_, err = f.Seek(seg.size, io.SeekStart)
+		}
+		if err != nil {
+			_ = f.Close()
+			return fmt.Errorf("open event segment: %w", err)
+		}
+		s.file, s.w = f, bufio.NewWriter(f)
+		return nil
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", firstID, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("create event segment: %w", err)
+	}
+	s.file, s.w = f, bufio.NewWriter(f)
+	s.segments = append(s.segments, segment{path: path, first: firstID, last: firstID - 1, modTime: time.Now(), indexed: true})
+	s.applyRetention()
+	return nil
+}
+
+// applyRetention removes the oldest segments (never the newest) while the
+// store is over its size budget or they are past MaxAge.
+func (s *Store) applyRetention() {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	cutoff := time.Now().Add(-s.cfg.MaxAge)
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		if total <= s.cfg.MaxBytes && oldest.modTime.After(cutoff) {
+			break
+		}
+		_ = os.Remove(oldest.path)
+		total -= oldest.size
+		s.segments = s.segments[1:]
+	}
+}
+
+// ReadFrom returns up to limit events with ids greater than after, in order.
+// It returns ErrEvicted if the event right after `after` is no longer stored.
+func (s *Store) ReadFrom(after uint64, limit int) ([]Event, error) {
+	s.mu.Lock()
+	if after >= s.lastID {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	if len(s.segments) == 0 || after+1 < s.segments[0].first {
+		s.mu.Unlock()
+		return nil, ErrEvicted
+	}
+	i, found := slices.BinarySearchFunc(s.segments, after+1, func(seg segment, id uint64) int {
+		return cmp.Compare(seg.first, id)
+	})
+	if !found {
+		i--
+	}
+	// Only read what has been flushed, without holding the lock: appends
+	// past these sizes are picked up by the next call.
+	segments := slices.Clone(s.segments[i:])
+	s.mu.Unlock()
+
+	out := make([]Event, 0, limit)
+	for _, seg := range segments {
+		if !seg.indexed {
+			seg = s.indexSegment(seg)
+		}
+		var err error
+		out, err = readSegment(seg, after, limit, out)
+		if err != nil {
+			if os.IsNotExist(err) && len(out) == 0 {
+				return nil, ErrEvicted
+			}
+			return out, err
+		}
+		if len(out) >= limit {
+			break
+		}
+		if len(out) > 0 {
+			after = out[len(out)-1].ID
+		}
+	}
+	return out, nil
+}
+
+// indexSegment builds the index of a segment loaded at startup and keeps it
+// for later reads. Segments are immutable once rotated, so the index built
+// from a copy stays valid.
+func (s *Store) indexSegment(seg segment) segment {
+	_, _, index, err := scanSegment(seg.path, seg.first, seg.size)
+	if err != nil {
+		// readSegment reports it.
+		return seg
+	}
+	seg.index, seg.indexed = index, true
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.segments {
+		if s.segments[i].path == seg.path && !s.segments[i].indexed {
+			s.segments[i].index, s.segments[i].indexed = index, true
+		}
+	}
+	return seg
+}
+
+func readSegment(seg segment, after uint64, limit int, out []Event) ([]Event, error) {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return out, err
+	}
+	defer f.Close()
+
+	offset := seg.offsetFor(after)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return out, err
+	}
+	r := bufio.NewReader(io.LimitReader(f, seg.size-offset))
+	for len(out) < limit {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		if id, ok := lineID(line); ok && id <= after {
+			continue
+		}
+		var evt Event
+		if err := json.Unmarshal(line, &evt); err != nil {
+			return out, fmt.Errorf("decode event in %s: %w", seg.path, err)
+		}
+		out = append(out, evt)
+	}
+	return out, nil
+}
+
+// Tail returns the newest n stored events, oldest first.
+func (s *Store) Tail(n int) ([]Event, error) {
+	last := s.LastID()
+	first := s.FirstID()
+	if last == 0 || n <= 0 {
+		return nil, nil
+	}
+	after := first - 1
+	if last-after > uint64(n) {
+		after = last - uint64(n)
+	}
+	events, err := s.ReadFrom(after, n)
+	if errors.Is(err, ErrEvicted) {
+		return nil, nil
+	}
+	return events, err
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file, s.w = nil, nil
+	return err
+}
+
+// maxStoreBacklog bounds the events published but not yet written to the
+// store; Publish waits beyond it.
+const maxStoreBacklog = 4096
+
+// storeWriter appends a hub's events to its store in order, off the hub's
+// lock.
+type storeWriter struct {
+	store *Store
+	slots chan struct{}
+	wake  chan struct{}
+	done  chan struct{}
+	// failed is set while appends fail, so the failure is logged once.
+	failed bool
+
+	mu      sync.Mutex
+	queue   []Event
+	closing bool
+}
+
+func newStoreWriter(store *Store) *storeWriter {
+	w := &storeWriter{
+		store: store,
+		slots: make(chan struct{}, maxStoreBacklog),
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// reserve waits for room for one event; enqueue or release gives it back.
+func (w *storeWriter) reserve() {
+	w.slots <- struct{}{}
+}
+
+func (w *storeWriter) release() {
+	<-w.slots
+}
+
+// enqueue queues evt, whose id must follow the last queued one.
+func (w *storeWriter) enqueue(evt Event) {
+	w.mu.Lock()
+	w.queue = append(w.queue, evt)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// queuedFrom returns up to limit queued events starting at id from, if the
+// queue holds it.
+func (w *storeWriter) queuedFrom(from uint64, limit int) []Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.queue) == 0 || from < w.queue[0].ID || from > w.queue[len(w.queue)-1].ID {
+		return nil
+	}
+	start := int(from - w.queue[0].ID)
+	end := min(len(w.queue), start+limit)
+	return slices.Clone(w.queue[start:end])
+}
+
+// run appends queued events until the writer is closed and drained. An event
+// leaves the queue only once it is in the store, so readers find it in one
+// or the other.
+func (w *storeWriter) run() {
+	defer close(w.done)
+	for {
+		w.mu.Lock()
+		if len(w.queue) == 0 {
+			closing := w.closing
+			w.mu.Unlock()
+			if closing {
+				return
+			}
+			<-w.wake
+			continue
+		}
+		evt := w.queue[0]
+		w.mu.Unlock()
+
+		err := w.store.Append(evt)
+		switch {
+		case err != nil && !w.failed:
+			log.Printf("[events] failed to persist to %s: %v", w.store.dir, err)
+		case err == nil && w.failed:
+			log.Printf("[events] persisting to %s again from event %d", w.store.dir, evt.ID)
+		}
+		w.failed = err != nil
+
+		w.mu.Lock()
+		w.queue[0] = Event{}
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+		w.release()
+	}
+}
+
+// close writes out what is queued and closes the store.
+func (w *storeWriter) close() {
+	w.mu.Lock()
+	w.closing = true
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	<-w.done
+	_ = w.store.Close()
+}
@@ -0,0 +1,312 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreReplaysBeyondRingAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir, StoreConfig{SegmentBytes: 256})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	h, err := NewHubWithStore(2, store)
+	if err != nil {
+		t.Fatalf("new hub: %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		h.Publish(Event{Type: "t", Data: json.RawMessage(fmt.Sprintf("%d", i))})
+	}
+	epoch := h.Epoch()
+	h.Close()
+
+	store, err = OpenStore(dir, StoreConfig{SegmentBytes: 256})
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	h, err = NewHubWithStore(2, store)
+	if err != nil {
+		t.Fatalf("new hub: %v", err)
+	}
+	defer h.Close()
+	if h.Epoch() != epoch || h.HighWaterMark() != 20 {
+		t.Fatalf("got epoch %q hwm %d, want %q 20", h.Epoch(), h.HighWaterMark(), epoch)
+	}
+	if id := h.Publish(Event{Type: "t", Data: json.RawMessage("21")}); id != 21 {
+		t.Fatalf("ids restarted: got %d, want 21", id)
+	}
+
+	ch, cancel := h.Resume(Position{Epoch: epoch, ID: 3})
+	defer cancel()
+	for want := uint64(4); want <= 21; want++ {
+		select {
+		case evt := <-ch:
+			if evt.ID != want || string(evt.Data) != fmt.Sprint(want) {
+				t.Fatalf("got event %d (%s %s), want %d", evt.ID, evt.Type, evt.Data, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for event %d", want)
+		}
+	}
+}
+
+// waitStored waits for the hub's writer to append event id.
+func waitStored(t *testing.T, store *Store, id uint64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for store.LastID() < id {
+		if time.Now().After(deadline) {
+			t.Fatalf("event %d not stored (last %d)", id, store.LastID())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStoreRetentionDropsOldSegments(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir, StoreConfig{SegmentBytes: 100, MaxBytes: 300})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	h, err := NewHubWithStore(4, store)
+	if err != nil {
+		t.Fatalf("new hub: %v", err)
+	}
+	defer h.Close()
+	for range 50 {
+		h.Publish(Event{Type: "t", Data: json.RawMessage(`"payload"`), ThreadID: "thr_1"})
+	}
+	waitStored(t, store, 50)
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if len(segments) > 5 {
+		t.Fatalf("retention kept %d segments", len(segments))
+	}
+	first := store.FirstID()
+	if first <= 1 {
+		t.Fatalf("expected old events to be dropped, first id %d", first)
+	}
+
+	ch, cancel := h.SubscribeFrom(1)
+	defer cancel()
+	var gap Gap
+	if evt := <-ch; evt.Type != GapEventType || json.Unmarshal(evt.Data, &gap) != nil {
+		t.Fatalf("expected gap, got %+v", evt)
+	}
+	if gap.Reason != GapEvicted || gap.From != 2 || gap.To != first-1 {
+		t.Fatalf("unexpected gap %+v (first retained %d)", gap, first)
+	}
+	if evt := <-ch; evt.ID != first {
+		t.Fatalf("replay resumed at %d, want %d", evt.ID, first)
+	}
+}
+
+func TestStoreDropsTornLastLine(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir, StoreConfig{})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	for id := uint64(1); id <= 3; id++ {
+		if err := store.Append(Event{ID: id, Type: "t", Data: json.RawMessage("1")}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	_ = store.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	f, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	_, _ = f.WriteString(`{"id":4,"type":"t","da`)
+	_ = f.Close()
+
+	store, err = OpenStore(dir, StoreConfig{})
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	defer store.Close()
+	if store.LastID() != 3 {
+		t.Fatalf("last id %d, want 3", store.LastID())
+	}
+	if err := store.Append(Event{ID: 4, Type: "t", Data: json.RawMessage("4")}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	events, err := store.ReadFrom(2, 10)
+	if err != nil || len(events) != 2 || events[1].ID != 4 || string(events[1].Data) != "4" {
+		t.Fatalf("read back %+v, %v", events, err)
+	}
+}
+
+func TestResumeFromAnotherEpochResets(t *testing.T) {
+	h := NewHub(4)
+	h.Publish(Event{Type: "t", Data: json.RawMessage("a")})
+	h.Publish(Event{Type: "t", Data: json.RawMessage("b")})
+
+	ch, cancel := h.Resume(Position{Epoch: "stale", ID: 1})
+	defer cancel()
+
+	var gap Gap
+	if evt := <-ch; evt.Type != GapEventType || json.Unmarshal(evt.Data, &gap) != nil || gap.Reason != GapReset {
+		t.Fatalf("expected reset gap, got %+v", evt)
+	}
+	if evt := <-ch; evt.ID != 1 {
+		t.Fatalf("got event %d, want full replay from 1", evt.ID)
+	}
+}
+
+func TestParsePosition(t *testing.T) {
+	cases := map[string]Position{
+		"42":        {ID: 42},
+		"a1b2c3-42": {Epoch: "a1b2c3", ID: 42},
+	}
+	for input, want := range cases {
+		got, err := ParsePosition(input)
+		if err != nil || got != want {
+			t.Fatalf("ParsePosition(%q) = %+v, %v; want %+v", input, got, err, want)
+		}
+		if got.String() != input {
+			t.Fatalf("String() = %q, want %q", got.String(), input)
+		}
+	}
+	if _, err := ParsePosition("abc-"); err == nil {
+		t.Fatalf("expected error for missing id")
+	}
+}
+
+func TestStoreReadFromAnyPosition(t *testing.T) {
+	dir := t.TempDir()
+	cfg := StoreConfig{SegmentBytes: 8 << 10}
+	store, err := OpenStore(dir, cfg)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	for id := uint64(1); id <= 1000; id++ {
+		if err := store.Append(Event{ID: id, Type: "t", Data: json.RawMessage(fmt.Sprint(id))}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	check := func(store *Store) {
+		t.Helper()
+		for _, after := range []uint64{0, 1, 63, 64, 65, 199, 200, 511, 998, 999} {
+			events, err := store.ReadFrom(after, 10)
+			if err != nil {
+				t.Fatalf("read from %d: %v", after, err)
+			}
+			want := min(10, int(1000-after))
+			if len(events) != want {
+				t.Fatalf("read from %d: got %d events, want %d", after, len(events), want)
+			}
+			for i, evt := range events {
+				if id := after + uint64(i) + 1; evt.ID != id || string(evt.Data) != fmt.Sprint(id) {
+					t.Fatalf("read from %d: event %d is %d (%s)", after, i, evt.ID, evt.Data)
+				}
+			}
+		}
+	}
+	check(store)
+	_ = store.Close()
+
+	// Segments loaded at startup are indexed on first read.
+	store, err = OpenStore(dir, cfg)
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	defer store.Close()
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix)); len(segments) < 3 {
+		t.Fatalf("expected several segments, got %d", len(segments))
+	}
+	check(store)
+}
+
+func TestStoreReplaysEventsStillQueued(t *testing.T) {
+	store, err := OpenStore(t.TempDir(), StoreConfig{})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	h, err := NewHubWithStore(2, store)
+	if err != nil {
+		t.Fatalf("new hub: %v", err)
+	}
+	defer h.Close()
+	h.Publish(Event{Type: "t", Data: json.RawMessage("1")})
+	waitStored(t, store, 1)
+
+	// Stall the disk: later events leave the ring before they are written.
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	store.mu.Lock()
+	store.w = bufio.NewWriterSize(pw, 16)
+	store.mu.Unlock()
+	for i := 2; i <= 10; i++ {
+		h.Publish(Event{Type: "t", Data: json.RawMessage(fmt.Sprint(i))})
+	}
+
+	ch, cancel := h.SubscribeFrom(1)
+	defer cancel()
+	for want := uint64(2); want <= 10; want++ {
+		select {
+		case evt := <-ch:
+			if evt.ID != want || string(evt.Data) != fmt.Sprint(want) {
+				t.Fatalf("got event %d (%s %s), want %d", evt.ID, evt.Type, evt.Data, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for event %d", want)
+		}
+	}
+	go func() { _, _ = io.Copy(io.Discard, pr) }()
+	waitStored(t, store, 10)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestStoreRecoversAfterFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir, StoreConfig{})
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	if err := store.Append(Event{ID: 1, Type: "t", Data: json.RawMessage("1")}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	store.mu.Lock()
+	store.w = bufio.NewWriter(failingWriter{})
+	store.mu.Unlock()
+	if err := store.Append(Event{ID: 2, Type: "t", Data: json.RawMessage("2")}); err == nil {
+		t.Fatalf("expected the injected write to fail")
+	}
+	for id := uint64(3); id <= 4; id++ {
+		if err := store.Append(Event{ID: id, Type: "t", Data: json.RawMessage(fmt.Sprint(id))}); err != nil {
+			t.Fatalf("append %d after a failure: %v", id, err)
+		}
+	}
+	_ = store.Close()
+
+	store, err = OpenStore(dir, StoreConfig{})
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	defer store.Close()
+	if store.LastID() != 4 {
+		t.Fatalf("last id %d, want 4", store.LastID())
+	}
+	events, err := store.ReadFrom(0, 10)
+	if err != nil || len(events) != 3 || events[0].ID != 1 || events[1].ID != 3 || events[2].ID != 4 {
+		t.Fatalf("read back %+v, %v", events, err)
+	}
+}
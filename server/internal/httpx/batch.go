@@ -0,0 +1,137 @@
+package httpx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"climate/server/internal/codex"
+)
+
+// maxBatchSize bounds the elements of one JSON-RPC batch.
+const maxBatchSize = 64
+
+// JSON-RPC error codes for failures on the bridge side, reported where a
+// JSON-RPC response is expected (/ws, batch elements).
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcInternalError  = -32603
+	rpcServerError    = -32000
+)
+
+// handshakeMethods are sent before the rest of a batch, in batch order:
+// codex answers nothing else until it has been initialized.
+var handshakeMethods = map[string]bool{
+	"initialize":  true,
+	"initialized": true,
+}
+
+// handleBatch answers a JSON-RPC batch on /rpc. Elements are sent to the
+// session concurrently (after any handshake), and the response array holds
+// one entry per request in request order: what /rpc would have answered for
+// it alone, or a JSON-RPC error for that element. As in JSON-RPC 2.0,
+// notifications and answers to codex's requests get no entry (failures are
+// logged), and a batch of only those is answered with 204 and no body.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request, clientKey string, body []byte) {
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "invalid json")
+		return
+	}
+	if len(batch) == 0 || len(batch) > maxBatchSize {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("batch must have 1 to %d elements", maxBatchSize))
+		return
+	}
+
+	payloads := make([]map[string]any, len(batch))
+	methods := make([]string, len(batch))
+	for i, raw := range batch {
+		payloads[i], _ = decodeJSON(raw)
+		methods[i], _ = payloads[i]["method"].(string)
+	}
+	log.Printf("[rpc] client=%s batch of %d: %s", clientKey, len(batch), strings.Join(methods, ","))
+
+	session, err := s.manager.Ensure(clientKey)
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+
+	responses := make([]json.RawMessage, len(batch))
+	for i, payload := range payloads {
+		if payload != nil && handshakeMethods[methods[i]] {
+			responses[i] = sendBatchElement(r.Context(), clientKey, session, payload)
+		}
+	}
+	var wg sync.WaitGroup
+	for i, payload := range payloads {
+		if payload == nil {
+			responses[i] = rpcError(nil, rpcInvalidRequest, "batch element must be a JSON-RPC object")
+			continue
+		}
+		if handshakeMethods[methods[i]] {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = sendBatchElement(r.Context(), clientKey, session, payload)
+		}()
+	}
+	wg.Wait()
+
+	responses = slices.DeleteFunc(responses, func(response json.RawMessage) bool { return response == nil })
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+// sendBatchElement sends payload and returns its entry in the batch
+// response, or nil if it is not a request.
+func sendBatchElement(ctx context.Context, clientKey string, session *codex.Session, payload map[string]any) json.RawMessage {
+	response, err := session.SendRPC(ctx, payload)
+	if !isRequest(payload) {
+		if err != nil {
+			log.Printf("[rpc] client=%s batch element without a response failed: %v", clientKey, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return rpcErrorFor(payload["id"], err)
+	}
+	return response
+}
+
+// isRequest reports whether payload is a JSON-RPC request, the only message
+// codex answers (and the bridge forwards under its own id).
+func isRequest(payload map[string]any) bool {
+	_, hasMethod := payload["method"].(string)
+	return hasMethod && payload["id"] != nil
+}
+
+// rpcErrorFor reports a failed send as a JSON-RPC error response for id.
+func rpcErrorFor(id any, err error) json.RawMessage {
+	code := rpcInternalError
+	if errors.Is(err, codex.ErrMaxSessions) || errors.Is(err, codex.ErrManagerClosed) {
+		code = rpcServerError
+	}
+	return rpcError(id, code, err.Error())
+}
+
+// rpcError builds a JSON-RPC error response for id (null if nil).
+func rpcError(id any, code int, message string) json.RawMessage {
+	data, _ := json.Marshal(map[string]any{
+		"id":    id,
+		"error": map[string]any{"code": code, "message": message},
+	})
+	return data
+}
@@ -0,0 +1,140 @@
+package httpx
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"climate/server/internal/events"
+)
+
+const (
+	minCoalesceInterval = 10 * time.Millisecond
+	maxCoalesceInterval = 5 * time.Second
+)
+
+// parseCoalesce reads `coalesce=250ms`; 0 means deltas are sent as they
+// arrive.
+func parseCoalesce(query url.Values) (time.Duration, error) {
+	value := strings.TrimSpace(query.Get("coalesce"))
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < minCoalesceInterval || d > maxCoalesceInterval {
+		return 0, fmt.Errorf("coalesce must be a duration between %s and %s", minCoalesceInterval, maxCoalesceInterval)
+	}
+	return d, nil
+}
+
+// coalescer merges streaming deltas per item for a coalescing /events
+// subscriber. Everything else flushes what is pending before it is sent, so
+// the stream stays in order.
+//
+// Merged events keep the method and params of the last delta with the
+// texts concatenated. Only the last event of a flush carries an SSE id (the
+// highest merged id): a client that drops mid-flush resumes from before it
+// and is sent every part again.
+type coalescer struct {
+	pending []*mergedDelta
+	byKey   map[mergeKey]*mergedDelta
+}
+
+type mergeKey struct {
+	itemID       string
+	method       string
+	summaryIndex int
+	contentIndex int
+}
+
+type mergedDelta struct {
+	last         events.Event
+	line, params map[string]json.RawMessage
+	text         []byte
+	parts        int
+}
+
+type deltaParams struct {
+	Delta        *string `json:"delta"`
+	SummaryIndex int     `json:"summaryIndex"`
+	ContentIndex int     `json:"contentIndex"`
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{byKey: make(map[mergeKey]*mergedDelta)}
+}
+
+// add buffers evt and reports true if it is a delta that can be merged.
+func (c *coalescer) add(evt events.Event) bool {
+	// An elided delta is sent as is: merged text is never re-elided.
+	if evt.Priority() != events.PriorityLow || evt.ItemID == "" || len(evt.Elided) > 0 {
+		return false
+	}
+	var line, fields map[string]json.RawMessage
+	var params deltaParams
+	if json.Unmarshal(evt.Data, &line) != nil ||
+		json.Unmarshal(line["params"], &fields) != nil ||
+		json.Unmarshal(line["params"], &params) != nil || params.Delta == nil {
+		return false
+	}
+
+	key := mergeKey{evt.ItemID, evt.Method, params.SummaryIndex, params.ContentIndex}
+	merged := c.byKey[key]
+	if merged == nil {
+		merged = &mergedDelta{}
+		c.byKey[key] = merged
+		c.pending = append(c.pending, merged)
+	}
+	merged.last = evt
+	merged.line, merged.params = line, fields
+	merged.text = append(merged.text, *params.Delta...)
+	merged.parts++
+	return true
+}
+
+func (c *coalescer) empty() bool {
+	return len(c.pending) == 0
+}
+
+// flush returns the merged events in the order their items first appeared,
+// and resets the coalescer.
+func (c *coalescer) flush() []events.Event {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	var lastID uint64
+	out := make([]events.Event, 0, len(c.pending))
+	for _, merged := range c.pending {
+		lastID = max(lastID, merged.last.ID)
+		out = append(out, merged.event())
+	}
+	for i := range out {
+		out[i].ID = 0
+	}
+	out[len(out)-1].ID = lastID
+
+	clear(c.byKey)
+	clear(c.pending)
+	c.pending = c.pending[:0]
+	return out
+}
+
+func (m *mergedDelta) event() events.Event {
+	evt := m.last
+	if m.parts == 1 {
+		return evt
+	}
+	delta, _ := json.Marshal(string(m.text))
+	m.params["delta"] = delta
+	params, err := json.Marshal(m.params)
+	if err != nil {
+		return evt
+	}
+	m.line["params"] = params
+	if data, err := json.Marshal(m.line); err == nil {
+		evt.Data = data
+	}
+	return evt
+}
@@ -0,0 +1,72 @@
+package httpx
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+
+	"climate/server/internal/events"
+)
+
+// eventFilter selects which hub events an /events subscriber receives:
+//
+//   - include: opt-in event types (e.g. codex/stderr)
+//   - threadId: only events about these threads; events not tied to a thread
+//     (lifecycle, responses to thread-less calls) are always delivered
+//   - method: only events whose JSON-RPC method (or bridge event type) starts
+//     with one of these prefixes
+//   - exclude: drop events whose method or type starts with one of these
+type eventFilter struct {
+	include map[string]bool
+	threads map[string]bool
+	methods []string
+	exclude []string
+}
+
+func parseEventFilter(query url.Values) eventFilter {
+	return eventFilter{
+		include: parseList(query["include"]),
+		threads: parseList(query["threadId"]),
+		methods: sortedKeys(parseList(query["method"])),
+		exclude: sortedKeys(parseList(query["exclude"])),
+	}
+}
+
+func (f eventFilter) allows(evt events.Event) bool {
+	if evt.Type == events.GapEventType {
+		// Gaps may affect any thread; the client decides what to re-fetch.
+		return true
+	}
+	if optInEvents[evt.Type] && !f.include[evt.Type] {
+		return false
+	}
+	if len(f.threads) > 0 && evt.ThreadID != "" && !f.threads[evt.ThreadID] {
+		return false
+	}
+	name := evt.Method
+	if name == "" {
+		name = evt.Type
+	}
+	if len(f.methods) > 0 && !hasAnyPrefix(name, f.methods) {
+		return false
+	}
+	return !hasAnyPrefix(name, f.exclude)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -13,20 +13,70 @@ import (
 	"time"
 
 	"climate/server/internal/codex"
+	"climate/server/internal/events"
 	"climate/server/internal/identity"
 )
 
+const (
+	codexStdoutEvent = "codex/stdout"
+	codexStderrEvent = "codex/stderr"
+)
+
+// optInEvents are only streamed to subscribers that list them in `include`.
+var optInEvents = map[string]bool{
+	codexStderrEvent: true,
+}
+
+const defaultMaxBodyBytes = 10 << 20
+
+// Options tunes the HTTP handlers. Zero values fall back to the defaults.
+type Options struct {
+	// MaxBodyBytes caps the size of a /rpc request body.
+	MaxBodyBytes int64
+	// IdempotencyTTL is how long a /rpc response is remembered for retries
+	// with the same Idempotency-Key. A negative value ignores the header.
+	IdempotencyTTL time.Duration
+	// WSOriginPatterns are the browser origins, besides the server's own
+	// host, that may open /ws (host globs such as `*.example.com`, or
+	// `scheme://host` globs). Requests without an Origin are always allowed.
+	WSOriginPatterns []string
+}
+
 type Server struct {
-	manager  *codex.Manager
-	identity identity.Provider
+	manager          *codex.Manager
+	identity         identity.Provider
+	maxBodyBytes     int64
+	idempotency      *idempotencyCache
+	wsOriginPatterns []string
 }
 
 func NewHandler(manager *codex.Manager, identity identity.Provider) http.Handler {
-	server := &Server{manager: manager, identity: identity}
+	return NewHandlerWithOptions(manager, identity, Options{})
+}
+
+func NewHandlerWithOptions(manager *codex.Manager, identity identity.Provider, opts Options) http.Handler {
+	server := &Server{manager: manager, identity: identity, maxBodyBytes: opts.MaxBodyBytes, wsOriginPatterns: opts.WSOriginPatterns}
+	if server.maxBodyBytes <= 0 {
+		server.maxBodyBytes = defaultMaxBodyBytes
+	}
+	if opts.IdempotencyTTL == 0 {
+		opts.IdempotencyTTL = defaultIdempotencyTTL
+	}
+	if opts.IdempotencyTTL > 0 {
+		server.idempotency = newIdempotencyCache(opts.IdempotencyTTL)
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", server.handleHealthz)
 	mux.HandleFunc("/rpc", server.handleRPC)
 	mux.HandleFunc("/events", server.handleEvents)
+	mux.HandleFunc("/events/poll", server.handleEventsPoll)
+	mux.HandleFunc("/ws", server.handleWS)
+	mux.HandleFunc("/approvals", server.handleApprovals)
+	mux.HandleFunc("/approvals/{id}", server.handleApprovalResponse)
+	mux.HandleFunc("/logs", server.handleLogs)
+	mux.HandleFunc("/session/lease", server.handleLease)
+	mux.HandleFunc("/v1/threads/{id}/state", server.handleThreadState)
+	mux.HandleFunc("/v1/blobs/{ref}", server.handleBlob)
 	return withCORS(mux)
 }
 
@@ -46,22 +96,70 @@ func (s *Server) handleRPC(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+	stream := strings.TrimSpace(r.URL.Query().Get("stream"))
+	if stream != "" && stream != "turn" {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "stream must be turn")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBodyBytes))
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("body exceeds %d bytes", tooLarge.Limit))
+			return
+		}
 		writeJSONError(w, http.StatusBadRequest, "bad_request", "failed to read body")
 		return
 	}
-	if len(body) == 0 {
+	if len(bytes.TrimSpace(body)) == 0 {
 		writeJSONError(w, http.StatusBadRequest, "bad_request", "empty body")
 		return
 	}
 
+	key, ok := parseIdempotencyKey(r)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("Idempotency-Key is longer than %d bytes", maxIdempotencyKeyLen))
+		return
+	}
+	if key != "" && s.idempotency != nil {
+		if stream != "" {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "Idempotency-Key cannot be used with stream")
+			return
+		}
+		s.idempotency.serve(w, r, clientKey, key, body, func(w http.ResponseWriter, r *http.Request) {
+			s.dispatchRPC(w, r, clientKey, body, "")
+		})
+		return
+	}
+	s.dispatchRPC(w, r, clientKey, body, stream)
+}
+
+// dispatchRPC answers a /rpc body: a batch, a single message, or with
+// stream a message followed by its turn's events.
+func (s *Server) dispatchRPC(w http.ResponseWriter, r *http.Request, clientKey string, body []byte, stream string) {
+	if trimmed := bytes.TrimSpace(body); trimmed[0] == '[' {
+		if stream != "" {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "stream needs a single request, not a batch")
+			return
+		}
+		s.handleBatch(w, r, clientKey, trimmed)
+		return
+	}
+
 	payload, err := decodeJSON(body)
 	if err != nil {
 		writeJSONError(w, http.StatusBadRequest, "bad_request", "invalid json")
 		return
 	}
 
+	if stream != "" {
+		if _, hasID := payload["id"]; !hasID || payload["method"] == nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "stream needs a request (method and id)")
+			return
+		}
+	}
+
 	if method, ok := payload["method"].(string); ok {
 		id := "-"
 		if idValue, ok := payload["id"]; ok {
@@ -76,9 +174,14 @@ func (s *Server) handleRPC(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if stream != "" {
+		s.streamTurn(w, r, clientKey, session, payload)
+		return
+	}
+
 	response, err := session.SendRPC(r.Context(), payload)
 	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, "rpc_failed", err.Error())
+		writeRPCError(w, err)
 		return
 	}
 
@@ -104,29 +207,68 @@ func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	lastEventID := parseLastEventID(r)
-	events := s.manager.Events(clientKey)
-	ch, cancel := events.SubscribeFrom(lastEventID)
+	filter := parseEventFilter(r.URL.Query())
+	interval, err := parseCoalesce(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if filter.include[codexStderrEvent] {
+		release := s.manager.WatchStderr(clientKey)
+		defer release()
+	}
+
+	from := parseLastEventID(r)
+	hub := s.manager.Events(clientKey)
+	ch, cancel := hub.Resume(from)
 	defer cancel()
 
+	version := negotiateStreamVersion(r)
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set(streamVersionHeader, strconv.Itoa(version))
 
-	log.Printf("[events] client=%s connected (from=%d)", clientKey, lastEventID)
+	log.Printf("[events] client=%s connected (from=%s, v%d)", clientKey, from, version)
 	defer log.Printf("[events] client=%s disconnected", clientKey)
 
-	snap := s.manager.Snapshot(clientKey)
-	writeSSE(w, SSEEvent{
+	snap, err := json.Marshal(s.manager.Snapshot(clientKey))
+	if err != nil {
+		snap = []byte("null")
+	}
+	writeSSE(w, streamEvent(events.Event{
 		Type: "session/snapshot",
+		Kind: events.KindBridge,
 		Data: snap,
-	})
+	}, version, hub.Epoch()))
 	flusher.Flush()
 
 	keepAlive := time.NewTicker(15 * time.Second)
 	defer keepAlive.Stop()
 
+	// With coalesce=, deltas wait up to interval to be merged; anything else
+	// is sent at once, after whatever deltas are pending.
+	var merger *coalescer
+	var flushTimer *time.Timer
+	var flushC <-chan time.Time
+	if interval > 0 {
+		merger = newCoalescer()
+		flushTimer = time.NewTimer(interval)
+		flushTimer.Stop()
+		defer flushTimer.Stop()
+	}
+	writePending := func() {
+		if merger == nil || merger.empty() {
+			return
+		}
+		for _, evt := range merger.flush() {
+			writeSSE(w, streamEvent(evt, version, hub.Epoch()))
+		}
+		flushTimer.Stop()
+		flushC = nil
+	}
+
 	for {
 		select {
 		case <-r.Context().Done():
@@ -134,20 +276,209 @@ func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 		case <-keepAlive.C:
 			_, _ = w.Write([]byte(": ping\n\n"))
 			flusher.Flush()
+		case <-flushC:
+			flushC = nil
+			writePending()
+			flusher.Flush()
 		case evt, ok := <-ch:
 			if !ok {
+				writePending()
+				flusher.Flush()
 				return
 			}
-			writeSSE(w, SSEEvent{
-				ID:   evt.ID,
-				Type: evt.Type,
-				Data: evt.Data,
-			})
+			if evt.Type == events.GapEventType {
+				log.Printf("[events] client=%s stream gap: %s", clientKey, evt.Data)
+			}
+			if !filter.allows(evt) {
+				continue
+			}
+			if merger != nil && merger.add(evt) {
+				if flushC == nil {
+					flushTimer.Reset(interval)
+					flushC = flushTimer.C
+				}
+				continue
+			}
+			writePending()
+			writeSSE(w, streamEvent(evt, version, hub.Epoch()))
 			flusher.Flush()
 		}
 	}
 }
 
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	clientKey, err := s.identity.ClientKey(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+
+	limit := 0
+	if value := strings.TrimSpace(r.URL.Query().Get("limit")); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"lines": s.manager.StderrLog(clientKey, limit),
+	})
+}
+
+// handleThreadState returns the bridge's materialized view of a thread so a
+// reconnecting client can render it without replaying deltas, then stream
+// from its eventId. Threads the bridge has seen nothing about are 404s.
+func (s *Server) handleThreadState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	clientKey, err := s.identity.ClientKey(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+
+	state, ok := s.manager.ThreadState(clientKey, r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "thread_not_found", "no state for this thread; use thread/read")
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// handleBlob serves a string elided from an event (see codex.ManagerOptions
+// ElideBytes). Range requests are supported so a client can page through
+// large output.
+func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	clientKey, err := s.identity.ClientKey(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+
+	ref := r.PathValue("ref")
+	data, created, ok := s.manager.Blob(clientKey, ref)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "blob_not_found", "blob expired or unknown; re-fetch with thread/read")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+ref+`"`)
+	http.ServeContent(w, r, "", created, bytes.NewReader(data))
+}
+
+// handleLease keeps the client's session alive through idle sweeps for
+// `duration` (e.g. `2h`); `duration=0` releases the lease.
+func (s *Server) handleLease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	clientKey, err := s.identity.ClientKey(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+
+	duration, err := time.ParseDuration(strings.TrimSpace(r.URL.Query().Get("duration")))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "invalid duration")
+		return
+	}
+	until, err := s.manager.Lease(clientKey, duration)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	resp := map[string]any{"leased": !until.IsZero()}
+	if !until.IsZero() {
+		resp["leaseUntil"] = until
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	clientKey, err := s.identity.ClientKey(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"approvals": s.manager.PendingRequests(clientKey),
+	})
+}
+
+// approvalResponse is the body of POST /approvals/{id}: exactly what the
+// client would otherwise put next to `id` in a JSON-RPC response.
+type approvalResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func (s *Server) handleApprovalResponse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	clientKey, err := s.identity.ClientKey(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "failed to read body")
+		return
+	}
+	var reply approvalResponse
+	if err := json.Unmarshal(body, &reply); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "invalid json")
+		return
+	}
+	if len(reply.Result) == 0 && len(reply.Error) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "expected result or error")
+		return
+	}
+
+	id := r.PathValue("id")
+	log.Printf("[approvals] client=%s id=%s", clientKey, id)
+	if err := s.manager.Respond(clientKey, id, reply.Result, reply.Error); err != nil {
+		if errors.Is(err, codex.ErrRequestNotFound) {
+			writeJSONError(w, http.StatusNotFound, "not_found", err.Error())
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "rpc_failed", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
 func decodeJSON(body []byte) (map[string]any, error) {
 	decoder := json.NewDecoder(bytes.NewReader(body))
 	decoder.UseNumber()
@@ -165,6 +496,12 @@ type jsonErrorResponse struct {
 	} `json:"error"`
 }
 
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
 func writeJSONError(w http.ResponseWriter, status int, code string, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -174,7 +511,22 @@ func writeJSONError(w http.ResponseWriter, status int, code string, message stri
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
+// writeRPCError reports a failed SendRPC.
+func writeRPCError(w http.ResponseWriter, err error) {
+	if errors.Is(err, codex.ErrNotSent) {
+		markUnsent(w)
+	}
+	if errors.Is(err, codex.ErrResponseTooLarge) {
+		writeJSONError(w, http.StatusBadGateway, "response_too_large", err.Error())
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, "rpc_failed", err.Error())
+}
+
+// writeManagerError reports a session that could not be started; nothing
+// was sent to codex.
 func writeManagerError(w http.ResponseWriter, err error) {
+	markUnsent(w)
 	if err == nil {
 		writeJSONError(w, http.StatusInternalServerError, "internal_error", "unknown error")
 		return
@@ -183,18 +535,25 @@ func writeManagerError(w http.ResponseWriter, err error) {
 		writeJSONError(w, http.StatusTooManyRequests, "max_sessions", err.Error())
 		return
 	}
+	if errors.Is(err, codex.ErrManagerClosed) {
+		writeJSONError(w, http.StatusServiceUnavailable, "shutting_down", err.Error())
+		return
+	}
 	writeJSONError(w, http.StatusInternalServerError, "internal_error", err.Error())
 }
 
 type SSEEvent struct {
-	ID   uint64
-	Type string
-	Data any
+	ID uint64
+	// Epoch, if set, is sent with the id as "<epoch>-<id>".
+	Epoch string
+	Type  string
+	Data  any
 }
 
 func writeSSE(w io.Writer, evt SSEEvent) {
 	if evt.ID != 0 {
-		_, _ = fmt.Fprintf(w, "id: %d\n", evt.ID)
+		pos := events.Position{Epoch: evt.Epoch, ID: evt.ID}
+		_, _ = fmt.Fprintf(w, "id: %s\n", pos)
 	}
 	if strings.TrimSpace(evt.Type) != "" {
 		_, _ = fmt.Fprintf(w, "event: %s\n", evt.Type)
@@ -209,6 +568,8 @@ func writeSSE(w io.Writer, evt SSEEvent) {
 		writeSSEDataLines(w, v)
 	case []byte:
 		writeSSEDataLines(w, string(v))
+	case json.RawMessage:
+		writeSSEDataLines(w, string(v))
 	default:
 		b, err := json.Marshal(v)
 		if err != nil {
@@ -234,16 +595,29 @@ func escapeJSONString(s string) string {
 	return strings.Trim(quoted, `"`)
 }
 
-func parseLastEventID(r *http.Request) uint64 {
+// parseList accepts both repeated and comma-separated query values.
+func parseList(values []string) map[string]bool {
+	out := make(map[string]bool)
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out[part] = true
+			}
+		}
+	}
+	return out
+}
+
+func parseLastEventID(r *http.Request) events.Position {
 	value := strings.TrimSpace(r.Header.Get("Last-Event-ID"))
 	if value == "" {
-		return 0
+		return events.Position{}
 	}
-	n, err := strconv.ParseUint(value, 10, 64)
+	pos, err := events.ParsePosition(value)
 	if err != nil {
-		return 0
+		return events.Position{}
 	}
-	return n
+	return pos
 }
 
 func withCORS(next http.Handler) http.Handler {
@@ -251,6 +625,7 @@ func withCORS(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
+		w.Header().Set("Access-Control-Expose-Headers", streamVersionHeader+", "+pollCursorHeader+", "+idempotentReplayHeader)
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -0,0 +1,143 @@
+package httpx
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"climate/server/internal/codex"
+	"climate/server/internal/events"
+	"climate/server/internal/identity"
+)
+
+func pollEvents(t *testing.T, baseURL, clientID string, query url.Values) (int, []testFrame, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/events/poll?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Client-ID", clientID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil, ""
+	}
+	var frames []testFrame
+	if err := json.NewDecoder(resp.Body).Decode(&frames); err != nil {
+		t.Fatalf("decode frames: %v", err)
+	}
+	return resp.StatusCode, frames, resp.Header.Get(pollCursorHeader)
+}
+
+func TestEventsPollLongPollsWithCursor(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	if status, _, _ := pollEvents(t, srv.URL, "client-a", url.Values{"wait": {"2m"}}); status != http.StatusBadRequest {
+		t.Fatalf("wait above the maximum: got %d", status)
+	}
+
+	if status, _ := postRPC(t, srv.URL, "client-a", map[string]any{"method": "streamTurn", "id": 1}); status != http.StatusOK {
+		t.Fatalf("streamTurn: %d", status)
+	}
+	_, frames, cursor := pollEvents(t, srv.URL, "client-a", url.Values{"method": {"item/"}})
+	if len(frames) < 2 || frames[0].Event != "session/snapshot" || frames[1].Event != "item/started" {
+		t.Fatalf("first poll must start with the snapshot and replay items: %+v", frames)
+	}
+	for _, frame := range frames[1:] {
+		if frame.Kind != events.KindNotification || frame.ID == "" {
+			t.Fatalf("unexpected frame: %+v", frame)
+		}
+	}
+	last := frames[len(frames)-1].ID
+	if cursor == "" || cursor == last {
+		t.Fatalf("cursor must move past filtered-out events: cursor %q, last frame %q", cursor, last)
+	}
+
+	start := time.Now()
+	_, frames, next := pollEvents(t, srv.URL, "client-a", url.Values{"after": {cursor}, "wait": {"200ms"}})
+	if len(frames) != 0 || next != cursor || time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("an idle poll must wait and return nothing: %+v (cursor %q)", frames, next)
+	}
+
+	done := make(chan []testFrame, 1)
+	go func() {
+		_, frames, _ := pollEvents(t, srv.URL, "client-a", url.Values{"after": {cursor}, "wait": {"5s"}})
+		done <- frames
+	}()
+	time.Sleep(100 * time.Millisecond)
+	postRPC(t, srv.URL, "client-a", map[string]any{"method": "ping", "id": 2})
+	select {
+	case frames := <-done:
+		if len(frames) == 0 || frames[0].Kind != events.KindResponse {
+			t.Fatalf("poll must return the new response: %+v", frames)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("poll did not return when an event arrived")
+	}
+
+	pos, err := events.ParsePosition(cursor)
+	if err != nil {
+		t.Fatalf("parse cursor: %v", err)
+	}
+	stale := events.Position{Epoch: "stale", ID: pos.ID}.String()
+	_, frames, next = pollEvents(t, srv.URL, "client-a", url.Values{"after": {stale}, "wait": {"0s"}})
+	if len(frames) == 0 || frames[0].Event != events.GapEventType || next == "" {
+		t.Fatalf("a position from another log must start with a gap: %+v", frames)
+	}
+}
+
+func TestEventsPollReportsAGapOnceWhenItsReplayExceedsAPage(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{CodexBin: fakeCodex, HubCapacity: 300})
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	// 900 completed items: the ring keeps 601-900 and the retained log
+	// 301-600, more than one page.
+	hub := manager.Events("client-a")
+	for range 900 {
+		hub.Publish(events.Event{Kind: events.KindNotification, Method: events.ItemCompletedMethod, ThreadID: "thr_1", Data: json.RawMessage(`{}`)})
+	}
+
+	cursor := events.Position{Epoch: hub.Epoch(), ID: 1}.String()
+	var gaps int
+	var last uint64
+	for polls := 0; last < 900; polls++ {
+		if polls == 10 {
+			t.Fatalf("did not reach the newest event in %d polls (last %d)", polls, last)
+		}
+		_, frames, next := pollEvents(t, srv.URL, "client-a", url.Values{"after": {cursor}, "wait": {"0s"}})
+		if len(frames) == 0 {
+			t.Fatalf("poll after %s returned nothing", cursor)
+		}
+		for _, frame := range frames {
+			if frame.Event == events.GapEventType {
+				gaps++
+				continue
+			}
+			pos, err := events.ParsePosition(frame.ID)
+			if err != nil {
+				t.Fatalf("parse frame id %q: %v", frame.ID, err)
+			}
+			if pos.ID <= last {
+				t.Fatalf("event %d repeated or out of order after %d", pos.ID, last)
+			}
+			last = pos.ID
+		}
+		cursor = next
+	}
+	if gaps != 1 {
+		t.Fatalf("the gap must be reported once, got %d", gaps)
+	}
+}
@@ -0,0 +1,73 @@
+package httpx
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"climate/server/internal/codex"
+	"climate/server/internal/identity"
+)
+
+func processAlive(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	stat := string(data)
+	end := strings.LastIndexByte(stat, ')')
+	return end >= 0 && !strings.HasPrefix(strings.TrimSpace(stat[end+1:]), "Z")
+}
+
+func TestCrashKillsCodexProcessGroup(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ch, cancel := manager.Events("client-a").SubscribeFrom(0)
+	defer cancel()
+
+	status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "spawnChild", "id": 1})
+	if status != http.StatusOK {
+		t.Fatalf("spawnChild status: got %d, want 200; body=%s", status, body)
+	}
+	var resp struct {
+		Result struct {
+			ChildPid int `json:"childPid"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Result.ChildPid == 0 {
+		t.Fatalf("missing child pid: %s", body)
+	}
+	if !processAlive(resp.Result.ChildPid) {
+		t.Fatalf("child %d not running before crash", resp.Result.ChildPid)
+	}
+
+	postRPC(t, srv.URL, "client-a", map[string]any{"method": "crash", "id": 2})
+
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case evt := <-ch:
+			if evt.Type != "session/exited" {
+				continue
+			}
+			if strings.Contains(string(evt.Data), `"survivors"`) {
+				t.Fatalf("unexpected survivors: %s", evt.Data)
+			}
+			if processAlive(resp.Result.ChildPid) {
+				t.Fatalf("child %d outlived codex", resp.Result.ChildPid)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("did not observe session/exited")
+		}
+	}
+}
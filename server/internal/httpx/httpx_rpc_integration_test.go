@@ -1,20 +1,27 @@
 package httpx
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"climate/server/internal/codex"
+	"climate/server/internal/events"
 	"climate/server/internal/identity"
+	"climate/server/internal/policy"
 )
 
 func buildFakeCodex(t *testing.T) string {
@@ -31,6 +38,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Msg struct {
@@ -43,6 +54,17 @@ func main() {
 	if len(os.Args) < 2 || os.Args[1] != "app-server" {
 		os.Exit(2)
 	}
+	var outMu sync.Mutex
+	reply := func(format string, args ...any) {
+		outMu.Lock()
+		defer outMu.Unlock()
+		fmt.Printf(format, args...)
+	}
+
+	// rendezvous requests are answered once two are pending: only
+	// requests sent concurrently get a response.
+	var rendezvous []string
+
 	sc := bufio.NewScanner(os.Stdin)
 	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
 	for sc.Scan() {
@@ -54,10 +76,81 @@ func main() {
 		if msg.Method == "crash" {
 			os.Exit(1)
 		}
-		if len(msg.ID) == 0 {
+		if len(msg.ID) == 0 || msg.Method == "" {
 			continue
 		}
-		fmt.Printf("{\"id\":%s,\"result\":{\"ok\":true,\"pid\":%d}}\n", string(msg.ID), os.Getpid())
+		id, method := string(msg.ID), msg.Method
+		switch method {
+		case "slow":
+			go func() {
+				time.Sleep(300 * time.Millisecond)
+				reply("{\"id\":%s,\"result\":{\"ok\":true,\"pid\":%d,\"method\":%q}}\n", id, os.Getpid(), method)
+			}()
+			continue
+		case "rendezvous":
+			rendezvous = append(rendezvous, id)
+			if len(rendezvous) == 2 {
+				for _, waiting := range rendezvous {
+					reply("{\"id\":%s,\"result\":{\"ok\":true,\"pid\":%d,\"method\":%q}}\n", waiting, os.Getpid(), method)
+				}
+				rendezvous = nil
+			}
+			continue
+		case "thread/start", "thread/resume":
+			reply("{\"id\":%s,\"result\":{\"thread\":{\"id\":\"thr_1\"},\"pid\":%d}}\n", id, os.Getpid())
+			continue
+		case "turn/start":
+			var params struct {
+				Script bool ` + "`json:\"script\"`" + `
+			}
+			_ = json.Unmarshal(msg.Params, &params)
+			if params.Script {
+				reply("{\"method\":\"turn/started\",\"params\":{\"threadId\":\"thr_1\",\"turn\":{\"id\":\"turn_1\",\"status\":\"inProgress\"}}}\n")
+			}
+			reply("{\"id\":%s,\"result\":{\"turn\":{\"id\":\"turn_1\",\"status\":\"inProgress\"}}}\n", id)
+			if params.Script {
+				reply("{\"method\":\"item/agentMessage/delta\",\"params\":{\"threadId\":\"thr_2\",\"turnId\":\"turn_9\",\"itemId\":\"msg_9\",\"delta\":\"elsewhere\"}}\n")
+				reply("{\"method\":\"item/agentMessage/delta\",\"params\":{\"threadId\":\"thr_1\",\"turnId\":\"turn_1\",\"itemId\":\"msg_1\",\"delta\":\"hi\"}}\n")
+				reply("{\"id\":\"srv_1\",\"method\":\"item/commandExecution/requestApproval\",\"params\":{\"threadId\":\"thr_1\",\"turnId\":\"turn_1\",\"itemId\":\"cmd_1\"}}\n")
+				reply("{\"method\":\"turn/completed\",\"params\":{\"threadId\":\"thr_1\",\"turn\":{\"id\":\"turn_1\",\"status\":\"completed\"}}}\n")
+				reply("{\"method\":\"thread/tokenUsage/updated\",\"params\":{\"threadId\":\"thr_1\",\"turnId\":\"turn_1\"}}\n")
+			}
+			continue
+		case "turn/interrupt":
+			var params struct {
+				TurnID string ` + "`json:\"turnId\"`" + `
+			}
+			_ = json.Unmarshal(msg.Params, &params)
+			fmt.Fprintf(os.Stderr, "interrupt %s\n", params.TurnID)
+		case "spawnChild":
+			child := exec.Command("sleep", "30")
+			if err := child.Start(); err != nil {
+				os.Exit(3)
+			}
+			reply("{\"id\":%s,\"result\":{\"pid\":%d,\"childPid\":%d}}\n", id, os.Getpid(), child.Process.Pid)
+			continue
+		case "streamTurn":
+			reply("{\"method\":\"turn/started\",\"params\":{\"threadId\":\"thr_1\",\"turn\":{\"id\":\"turn_1\",\"status\":\"inProgress\"}}}\n")
+			reply("{\"method\":\"item/started\",\"params\":{\"threadId\":\"thr_1\",\"turnId\":\"turn_1\",\"item\":{\"id\":\"msg_1\",\"type\":\"agentMessage\"}}}\n")
+			for _, delta := range []string{"Hel", "lo"} {
+				reply("{\"method\":\"item/agentMessage/delta\",\"params\":{\"threadId\":\"thr_1\",\"turnId\":\"turn_1\",\"itemId\":\"msg_1\",\"delta\":%q}}\n", delta)
+			}
+			reply("{\"method\":\"thread/tokenUsage/updated\",\"params\":{\"threadId\":\"thr_1\",\"tokenUsage\":{\"total\":{\"totalTokens\":42}}}}\n")
+		case "bigOutput":
+			big := strings.Repeat("0123456789", 400)
+			reply("{\"method\":\"item/completed\",\"params\":{\"threadId\":\"thr_1\",\"turnId\":\"turn_1\",\"item\":{\"id\":\"cmd_1\",\"type\":\"commandExecution\",\"aggregatedOutput\":%q}}}\n", big)
+			reply("{\"id\":%s,\"result\":{\"output\":%q}}\n", id, big)
+			continue
+		case "bigDiff":
+			reply("{\"method\":\"turn/started\",\"params\":{\"threadId\":\"thr_1\",\"turn\":{\"id\":\"turn_1\",\"status\":\"inProgress\"}}}\n")
+			reply("{\"method\":\"turn/diff/updated\",\"params\":{\"threadId\":\"thr_1\",\"turnId\":\"turn_1\",\"diff\":%q}}\n", strings.Repeat("+line\n", 1000))
+		case "warn":
+			fmt.Fprintln(os.Stderr, "warning: disk almost full")
+		case "askFirst":
+			// Emit a server-initiated request that reuses the caller's id.
+			reply("{\"id\":%s,\"method\":\"item/commandExecution/requestApproval\",\"params\":{\"threadId\":\"thr_1\",\"itemId\":\"item_1\",\"command\":\"go test ./...\",\"parsedCmd\":[{\"type\":\"unknown\",\"cmd\":\"go test ./...\"}]}}\n", id)
+		}
+		reply("{\"id\":%s,\"result\":{\"ok\":true,\"pid\":%d,\"method\":%q}}\n", id, os.Getpid(), method)
 	}
 }
 `
@@ -228,3 +321,1159 @@ func TestCrashRecoveryRestartsCodex(t *testing.T) {
 		t.Fatalf("expected restart pid to differ; got %d then %d", r1.Result.Pid, r2.Result.Pid)
 	}
 }
+
+func TestSameIDFromConcurrentCallersDoesNotCollide(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	type rpcResp struct {
+		ID     int `json:"id"`
+		Result struct {
+			Method string `json:"method"`
+		} `json:"result"`
+	}
+
+	methods := []string{"slow", "ping"}
+	results := make([]rpcResp, len(methods))
+	statuses := make([]int, len(methods))
+	bodies := make([][]byte, len(methods))
+	var wg sync.WaitGroup
+	for i, method := range methods {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], bodies[i] = postRPC(t, srv.URL, "client-a", map[string]any{"method": method, "id": 1})
+			_ = json.Unmarshal(bodies[i], &results[i])
+		}()
+		// Make sure "slow" is pending upstream before "ping" is sent.
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+
+	for i, method := range methods {
+		if statuses[i] != http.StatusOK {
+			t.Fatalf("%s status: got %d, want 200; body=%s", method, statuses[i], bodies[i])
+		}
+		if results[i].ID != 1 {
+			t.Fatalf("%s: got id %d, want client id 1; body=%s", method, results[i].ID, bodies[i])
+		}
+		if results[i].Result.Method != method {
+			t.Fatalf("%s: got response for %q; body=%s", method, results[i].Result.Method, bodies[i])
+		}
+	}
+}
+
+func TestServerRequestIsNotMistakenForResponse(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "askFirst", "id": 7})
+	if status != http.StatusOK {
+		t.Fatalf("status: got %d, want 200; body=%s", status, body)
+	}
+	var resp struct {
+		ID     int             `json:"id"`
+		Method string          `json:"method"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("unmarshal rpc: %v; body=%s", err, body)
+	}
+	if resp.Method != "" || len(resp.Result) == 0 {
+		t.Fatalf("expected the response, got a server request: %s", body)
+	}
+	if resp.ID != 7 {
+		t.Fatalf("got id %d, want 7", resp.ID)
+	}
+}
+
+func TestStdoutEventsAreTaggedWithThreadAndMethod(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ch, cancel := manager.Events("client-a").SubscribeFrom(0)
+	defer cancel()
+
+	if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "askFirst", "id": 1}); status != http.StatusOK {
+		t.Fatalf("askFirst status: got %d, want 200; body=%s", status, body)
+	}
+	if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "thread/start", "id": 2}); status != http.StatusOK {
+		t.Fatalf("thread/start status: got %d, want 200; body=%s", status, body)
+	}
+
+	want := map[string]string{
+		"item/commandExecution/requestApproval": "thr_1",
+		"askFirst":                              "",
+		"thread/start":                          "thr_1",
+	}
+	timeout := time.After(3 * time.Second)
+	for len(want) > 0 {
+		select {
+		case evt := <-ch:
+			if evt.Type != "codex/stdout" {
+				continue
+			}
+			threadID, ok := want[evt.Method]
+			if !ok {
+				t.Fatalf("unexpected method tag %q on %s", evt.Method, evt.Data)
+			}
+			if evt.ThreadID != threadID {
+				t.Fatalf("%s: got thread %q, want %q", evt.Method, evt.ThreadID, threadID)
+			}
+			delete(want, evt.Method)
+		case <-timeout:
+			t.Fatalf("timed out; still waiting for %v", want)
+		}
+	}
+}
+
+func TestApprovalsListAndRespond(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "askFirst", "id": 1}); status != http.StatusOK {
+		t.Fatalf("askFirst status: got %d, want 200; body=%s", status, body)
+	}
+
+	type approvalsResp struct {
+		Approvals []codex.ServerRequest `json:"approvals"`
+	}
+	listApprovals := func() approvalsResp {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/approvals", nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("X-Client-ID", "client-a")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("do request: %v", err)
+		}
+		defer resp.Body.Close()
+		var out approvalsResp
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatalf("decode approvals: %v", err)
+		}
+		return out
+	}
+	respond := func(id string) int {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/approvals/"+id, bytes.NewReader([]byte(`{"result":{"decision":"accept"}}`)))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("X-Client-ID", "client-a")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("do request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	pending := listApprovals()
+	if len(pending.Approvals) != 1 {
+		t.Fatalf("got %d pending approvals, want 1", len(pending.Approvals))
+	}
+	approval := pending.Approvals[0]
+	if approval.Method != "item/commandExecution/requestApproval" {
+		t.Fatalf("unexpected approval method %q", approval.Method)
+	}
+	if snap := manager.Snapshot("client-a"); len(snap.PendingApprovals) != 1 {
+		t.Fatalf("snapshot: got %d pending approvals, want 1", len(snap.PendingApprovals))
+	}
+
+	if status := respond(approval.ID); status != http.StatusOK {
+		t.Fatalf("respond status: got %d, want 200", status)
+	}
+	if pending := listApprovals(); len(pending.Approvals) != 0 {
+		t.Fatalf("approval still pending after response: %+v", pending.Approvals)
+	}
+	if status := respond(approval.ID); status != http.StatusNotFound {
+		t.Fatalf("second respond status: got %d, want 404", status)
+	}
+}
+
+func TestPolicyAnswersMatchingApproval(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	engine, err := policy.New(policy.Config{Rules: []policy.Rule{
+		{Name: "go-tests", Decision: policy.DecisionAccept, Kind: policy.KindCommand, Commands: []string{"go test *"}},
+	}})
+	if err != nil {
+		t.Fatalf("policy: %v", err)
+	}
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{CodexBin: fakeCodex, Policy: engine})
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "askFirst", "id": 1}); status != http.StatusOK {
+		t.Fatalf("askFirst status: got %d, want 200; body=%s", status, body)
+	}
+	if pending := manager.PendingRequests("client-a"); len(pending) != 0 {
+		t.Fatalf("policy-answered approval should not be pending: %+v", pending)
+	}
+
+	ch, cancel := manager.Events("client-a").SubscribeFrom(0)
+	defer cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case evt := <-ch:
+			if strings.Contains(string(evt.Data), "item/commandExecution/requestApproval") && evt.Type != "policy/decision" {
+				t.Fatalf("approval leaked to clients: %s", evt.Data)
+			}
+			if evt.Type != "policy/decision" {
+				continue
+			}
+			var decision struct {
+				Decision string `json:"decision"`
+				Rule     string `json:"rule"`
+			}
+			if err := json.Unmarshal(evt.Data, &decision); err != nil {
+				t.Fatalf("decode decision: %v", err)
+			}
+			if decision.Decision != "accept" || decision.Rule != "go-tests" {
+				t.Fatalf("unexpected decision: %s", evt.Data)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("did not observe policy/decision event")
+		}
+	}
+}
+
+func TestRespawnReplaysInitializeAndResumesThreads(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	steps := []map[string]any{
+		{"method": "initialize", "id": 1, "params": map[string]any{"clientInfo": map[string]any{"name": "test"}}},
+		{"method": "initialized"},
+		{"method": "thread/start", "id": 2, "params": map[string]any{}},
+	}
+	for _, step := range steps {
+		if status, body := postRPC(t, srv.URL, "client-a", step); status != http.StatusOK {
+			t.Fatalf("%v status: got %d, want 200; body=%s", step["method"], status, body)
+		}
+	}
+
+	if status, _ := postRPC(t, srv.URL, "client-a", map[string]any{"method": "crash", "id": 3}); status == http.StatusOK {
+		t.Fatalf("expected crash to fail")
+	}
+	if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "ping", "id": 4}); status != http.StatusOK {
+		t.Fatalf("ping after crash status: got %d, want 200; body=%s", status, body)
+	}
+
+	// A client re-initializing after the respawn gets the replayed handshake.
+	status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "initialize", "id": 5, "params": map[string]any{}})
+	if status != http.StatusOK || !strings.Contains(string(body), `"id":5`) {
+		t.Fatalf("initialize after respawn: status=%d body=%s", status, body)
+	}
+
+	ch, cancel := manager.Events("client-a").SubscribeFrom(0)
+	defer cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case evt := <-ch:
+			if evt.Type != "session/respawned" {
+				continue
+			}
+			var restored struct {
+				Initialized bool     `json:"initialized"`
+				Threads     []string `json:"threads"`
+			}
+			if err := json.Unmarshal(evt.Data, &restored); err != nil {
+				t.Fatalf("decode respawned: %v", err)
+			}
+			if !restored.Initialized || len(restored.Threads) != 1 || restored.Threads[0] != "thr_1" {
+				t.Fatalf("unexpected restore: %s", evt.Data)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("did not observe session/respawned event")
+		}
+	}
+}
+
+func TestSupervisorRestartsCrashedCodexWhileSubscribed(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ch, cancel := manager.Events("client-a").SubscribeFrom(0)
+	defer cancel()
+
+	if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "ping", "id": 1}); status != http.StatusOK {
+		t.Fatalf("ping status: got %d, want 200; body=%s", status, body)
+	}
+	if status, _ := postRPC(t, srv.URL, "client-a", map[string]any{"method": "crash", "id": 2}); status == http.StatusOK {
+		t.Fatalf("expected crash to fail")
+	}
+
+	want := []string{"session/spawned", "session/exited", "session/restarting", "session/spawned"}
+	var seen []string
+	timeout := time.After(3 * time.Second)
+	for len(seen) < len(want) {
+		select {
+		case evt := <-ch:
+			if !strings.HasPrefix(evt.Type, "session/") {
+				continue
+			}
+			if evt.Type == "session/exited" && !strings.Contains(string(evt.Data), `"reason":"crash"`) {
+				t.Fatalf("unexpected exit event: %s", evt.Data)
+			}
+			seen = append(seen, evt.Type)
+		case <-timeout:
+			t.Fatalf("timed out; saw lifecycle events %v, want %v", seen, want)
+		}
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Fatalf("lifecycle events: got %v, want %v", seen, want)
+		}
+	}
+	if manager.RunningSessions() != 1 {
+		t.Fatalf("expected codex to be running again, got %d sessions", manager.RunningSessions())
+	}
+}
+
+func TestStderrIsCapturedForLogsAndOptInEvents(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events?include=codex/stderr", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Client-ID", "client-a")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "event: session/snapshot") {
+			break
+		}
+	}
+
+	if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "warn", "id": 1}); status != http.StatusOK {
+		t.Fatalf("warn status: got %d, want 200; body=%s", status, body)
+	}
+
+	seenEvent := false
+	for scanner.Scan() {
+		if scanner.Text() == "event: codex/stderr" {
+			seenEvent = true
+			break
+		}
+	}
+	if !seenEvent {
+		t.Fatalf("did not observe codex/stderr event")
+	}
+
+	logsReq, err := http.NewRequest(http.MethodGet, srv.URL+"/logs?limit=10", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	logsReq.Header.Set("X-Client-ID", "client-a")
+	logsResp, err := http.DefaultClient.Do(logsReq)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	defer logsResp.Body.Close()
+	var logs struct {
+		Lines []codex.LogLine `json:"lines"`
+	}
+	if err := json.NewDecoder(logsResp.Body).Decode(&logs); err != nil {
+		t.Fatalf("decode logs: %v", err)
+	}
+	if len(logs.Lines) != 1 || logs.Lines[0].Text != "warning: disk almost full" || logs.Lines[0].PID == 0 {
+		t.Fatalf("unexpected logs: %+v", logs.Lines)
+	}
+}
+
+func TestManagerCloseInterruptsTurnsAndStopsCodex(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{CodexBin: fakeCodex, StopGrace: time.Second})
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	status, body := postRPC(t, srv.URL, "client-a", map[string]any{
+		"method": "turn/start",
+		"id":     1,
+		"params": map[string]any{"threadId": "thr_1"},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("turn/start status: got %d, want 200; body=%s", status, body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := manager.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if manager.RunningSessions() != 0 {
+		t.Fatalf("expected no running sessions after close, got %d", manager.RunningSessions())
+	}
+
+	interrupted := false
+	for _, line := range manager.StderrLog("client-a", 0) {
+		if line.Text == "interrupt turn_1" {
+			interrupted = true
+		}
+	}
+	if !interrupted {
+		t.Fatalf("turn was not interrupted before shutdown: %+v", manager.StderrLog("client-a", 0))
+	}
+
+	if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "ping", "id": 2}); status != http.StatusServiceUnavailable {
+		t.Fatalf("rpc after close: got %d, want 503; body=%s", status, body)
+	}
+}
+
+func TestRPCTimeoutHonoursMethodOverrides(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+
+	cases := []struct {
+		name      string
+		overrides map[string]time.Duration
+		want      int
+	}{
+		{name: "default", want: http.StatusInternalServerError},
+		{name: "override", overrides: map[string]time.Duration{"Slow": time.Second}, want: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			manager := codex.NewManagerWithOptions(codex.ManagerOptions{
+				CodexBin:       fakeCodex,
+				RPCTimeout:     100 * time.Millisecond,
+				MethodTimeouts: tc.overrides,
+			})
+			srv := httptest.NewServer(NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"}))
+			defer srv.Close()
+
+			status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "slow", "id": 1})
+			if status != tc.want {
+				t.Fatalf("status: got %d, want %d; body=%s", status, tc.want, body)
+			}
+			if tc.want != http.StatusOK && !strings.Contains(string(body), "timed out") {
+				t.Fatalf("expected a timeout error, got %s", body)
+			}
+		})
+	}
+}
+
+func TestRPCRejectsOversizedBody(t *testing.T) {
+	manager := codex.NewManager("false")
+	handler := NewHandlerWithOptions(manager, identity.Header{HeaderName: "X-Client-ID"}, Options{MaxBodyBytes: 64})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "ping", "id": 1, "params": strings.Repeat("x", 128)})
+	if status != http.StatusRequestEntityTooLarge || !strings.Contains(string(body), "body_too_large") {
+		t.Fatalf("got %d %s, want 413 body_too_large", status, body)
+	}
+}
+
+func TestIdleReaperSparesBusyAndLeasedSessions(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{
+		CodexBin:        fakeCodex,
+		IdleTTL:         100 * time.Millisecond,
+		JanitorInterval: 20 * time.Millisecond,
+	})
+	srv := httptest.NewServer(NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"}))
+	defer srv.Close()
+
+	// A turn is in progress: codex owes the client more work.
+	if status, body := postRPC(t, srv.URL, "turning", map[string]any{
+		"method": "turn/start", "id": 1, "params": map[string]any{"threadId": "thr_1"},
+	}); status != http.StatusOK {
+		t.Fatalf("turn/start: %d %s", status, body)
+	}
+
+	// Nothing running, but the client asked to keep the session around.
+	if status, body := postRPC(t, srv.URL, "leased", map[string]any{"method": "ping", "id": 1}); status != http.StatusOK {
+		t.Fatalf("ping: %d %s", status, body)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/session/lease?duration=1h", nil)
+	req.Header.Set("X-Client-ID", "leased")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("lease: %v", err)
+	}
+	var lease struct {
+		Leased     bool      `json:"leased"`
+		LeaseUntil time.Time `json:"leaseUntil"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&lease)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !lease.Leased || time.Until(lease.LeaseUntil) < 59*time.Minute {
+		t.Fatalf("lease: status %d, %+v", resp.StatusCode, lease)
+	}
+
+	// Truly idle.
+	if status, body := postRPC(t, srv.URL, "idle", map[string]any{"method": "ping", "id": 1}); status != http.StatusOK {
+		t.Fatalf("ping: %d %s", status, body)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for manager.Snapshot("idle").CodexRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle session was never reaped")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	for _, key := range []string{"turning", "leased"} {
+		if !manager.Snapshot(key).CodexRunning {
+			t.Fatalf("%s session was reaped", key)
+		}
+	}
+}
+
+func TestEventsV2NamesEventsByMethodAndClassifiesThem(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Client-ID", "client-a")
+	req.Header.Set("X-Climate-Stream-Version", "2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("X-Climate-Stream-Version"); got != "2" {
+		t.Fatalf("negotiated stream version %q, want 2", got)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if scanner.Text() == "event: session/snapshot" {
+			break
+		}
+	}
+
+	if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "askFirst", "id": 1}); status != http.StatusOK {
+		t.Fatalf("askFirst status: got %d, want 200; body=%s", status, body)
+	}
+
+	type envelope struct {
+		Kind     string          `json:"kind"`
+		Method   string          `json:"method"`
+		ThreadID string          `json:"threadId"`
+		Payload  json.RawMessage `json:"payload"`
+	}
+	want := map[string]string{
+		"item/commandExecution/requestApproval": "serverRequest",
+		"askFirst":                              "response",
+	}
+	name := ""
+	for len(want) > 0 && scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "event: "); ok {
+			name = value
+			continue
+		}
+		value, ok := strings.CutPrefix(line, "data: ")
+		if !ok || want[name] == "" {
+			continue
+		}
+		var env envelope
+		if err := json.Unmarshal([]byte(value), &env); err != nil {
+			t.Fatalf("%s: decode envelope: %v (%s)", name, err, value)
+		}
+		if env.Kind != want[name] || env.Method != name || !json.Valid(env.Payload) {
+			t.Fatalf("%s: unexpected envelope %s", name, value)
+		}
+		if name == "item/commandExecution/requestApproval" && env.ThreadID != "thr_1" {
+			t.Fatalf("%s: got thread %q, want thr_1", name, env.ThreadID)
+		}
+		delete(want, name)
+	}
+	if len(want) > 0 {
+		t.Fatalf("did not observe v2 events %v", want)
+	}
+}
+
+func TestThreadStateFoldsNotifications(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, method := range []string{"streamTurn", "askFirst"} {
+		if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": method, "id": 1}); status != http.StatusOK {
+			t.Fatalf("%s status: got %d, want 200; body=%s", method, status, body)
+		}
+	}
+
+	getState := func(threadID string) (int, codex.ThreadState) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/v1/threads/"+threadID+"/state", nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("X-Client-ID", "client-a")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("do request: %v", err)
+		}
+		defer resp.Body.Close()
+		var state codex.ThreadState
+		_ = json.NewDecoder(resp.Body).Decode(&state)
+		return resp.StatusCode, state
+	}
+
+	status, state := getState("thr_1")
+	if status != http.StatusOK {
+		t.Fatalf("state status: got %d, want 200", status)
+	}
+	if state.Turn == nil || state.Turn.ID != "turn_1" || state.Turn.Status != "inProgress" || len(state.Turn.Items) != 1 {
+		t.Fatalf("unexpected turn: %+v", state.Turn)
+	}
+	if item := state.Turn.Items[0]; item.ID != "msg_1" || item.Type != "agentMessage" || item.Text != "Hello" {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+	if !strings.Contains(string(state.TokenUsage), "42") {
+		t.Fatalf("token usage not tracked: %s", state.TokenUsage)
+	}
+	if len(state.PendingApprovals) != 1 || state.PendingApprovals[0].ItemID != "item_1" {
+		t.Fatalf("pending approvals: %+v", state.PendingApprovals)
+	}
+	if state.EventID < state.PendingApprovals[0].EventID || state.Epoch == "" {
+		t.Fatalf("state at event %d (epoch %q) does not cover its approval", state.EventID, state.Epoch)
+	}
+
+	if status, _ := getState("thr_unknown"); status != http.StatusNotFound {
+		t.Fatalf("unknown thread status: got %d, want 404", status)
+	}
+
+	snap := manager.Snapshot("client-a")
+	if len(snap.Threads) != 1 || snap.Threads[0].ThreadID != "thr_1" || snap.Threads[0].Turn == nil {
+		t.Fatalf("snapshot threads: %+v", snap.Threads)
+	}
+}
+
+func TestThreadStateKeepsElidedDiffs(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{CodexBin: fakeCodex, ElideBytes: 1024})
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	if status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "bigDiff", "id": 1}); status != http.StatusOK {
+		t.Fatalf("status: got %d, want 200; body=%s", status, body)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/v1/threads/thr_1/state", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Client-ID", "client-a")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	defer resp.Body.Close()
+	var state codex.ThreadState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatalf("decode state: %v", err)
+	}
+	if state.Turn == nil || state.Turn.Diff != strings.Repeat("+line\n", 1000) {
+		t.Fatalf("state lost the elided diff: %+v", state.Turn)
+	}
+}
+
+func TestLargeEventStringsAreElidedToBlobs(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{CodexBin: fakeCodex, ElideBytes: 1024})
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "bigOutput", "id": 1})
+	if status != http.StatusOK || len(body) < 4000 {
+		t.Fatalf("/rpc must return the full result: status %d, %d bytes", status, len(body))
+	}
+
+	ch, cancel := manager.Events("client-a").SubscribeFrom(0)
+	defer cancel()
+	var ref string
+	for ref == "" {
+		select {
+		case evt := <-ch:
+			if evt.Method != "item/completed" {
+				continue
+			}
+			var note struct {
+				Params struct {
+					Item struct {
+						AggregatedOutput struct {
+							Elided bool   `json:"elided"`
+							Bytes  int    `json:"bytes"`
+							Ref    string `json:"ref"`
+						} `json:"aggregatedOutput"`
+					} `json:"item"`
+				} `json:"params"`
+			}
+			if !bytes.Contains(evt.Data, bytes.Repeat([]byte("0123456789"), 400)) {
+				t.Fatalf("the event must keep the full line for v1: %d bytes", len(evt.Data))
+			}
+			if err := json.Unmarshal(evt.Elided, &note); err != nil {
+				t.Fatalf("decode elided event: %v (%s)", err, evt.Elided)
+			}
+			out := note.Params.Item.AggregatedOutput
+			if !out.Elided || out.Bytes != 4000 || out.Ref == "" {
+				t.Fatalf("unexpected reference: %+v", out)
+			}
+			ref = out.Ref
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for item/completed")
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/v1/blobs/"+ref, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Client-ID", "client-a")
+	req.Header.Set("Range", "bytes=10-19")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	defer resp.Body.Close()
+	part, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(part) != "0123456789" {
+		t.Fatalf("range: got %d %q", resp.StatusCode, part)
+	}
+
+	req.Header.Set("X-Client-ID", "client-b")
+	req.Header.Del("Range")
+	other, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	other.Body.Close()
+	if other.StatusCode != http.StatusNotFound {
+		t.Fatalf("blob leaked to another client: status %d", other.StatusCode)
+	}
+}
+
+func TestOversizedCodexLinesFailTheRequestAndKeepTheSession(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{CodexBin: fakeCodex, MaxLineBytes: 1024})
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	status, body := postRPC(t, srv.URL, "client-a", map[string]any{"method": "bigOutput", "id": 1})
+	if status != http.StatusBadGateway || !strings.Contains(string(body), "response_too_large") {
+		t.Fatalf("expected response_too_large, got %d: %s", status, body)
+	}
+
+	ch, cancel := manager.Events("client-a").SubscribeFrom(0)
+	defer cancel()
+	var methods []string
+	for len(methods) < 2 {
+		select {
+		case evt := <-ch:
+			if evt.Type != "session/error" {
+				continue
+			}
+			var info struct {
+				Reason string `json:"reason"`
+				Bytes  int    `json:"bytes"`
+				Limit  int    `json:"limit"`
+				Method string `json:"method"`
+			}
+			if err := json.Unmarshal(evt.Data, &info); err != nil {
+				t.Fatalf("decode session/error: %v (%s)", err, evt.Data)
+			}
+			if info.Reason != "line_too_long" || info.Bytes <= info.Limit || info.Limit != 1024 {
+				t.Fatalf("unexpected session/error: %+v", info)
+			}
+			methods = append(methods, info.Method)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for session/error, got %v", methods)
+		}
+	}
+	if methods[0] != "item/completed" || methods[1] != "bigOutput" {
+		t.Fatalf("session/error methods: %v", methods)
+	}
+
+	status, body = postRPC(t, srv.URL, "client-a", map[string]any{"method": "ping", "id": 2})
+	if status != http.StatusOK || !strings.Contains(string(body), `"method":"ping"`) {
+		t.Fatalf("session must keep working after an oversized line: %d %s", status, body)
+	}
+}
+
+func TestRPCStreamTurnFollowsTheTurnUntilCompleted(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	post := func(query string, payload any) *http.Response {
+		t.Helper()
+		body, _ := json.Marshal(payload)
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/rpc"+query, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("X-Client-ID", "client-a")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("do request: %v", err)
+		}
+		return resp
+	}
+
+	resp := post("?stream=bogus", map[string]any{"id": 1, "method": "turn/start"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown stream mode: got %d", resp.StatusCode)
+	}
+	resp = post("?stream=turn", map[string]any{"method": "initialized"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("stream without a request id: got %d", resp.StatusCode)
+	}
+
+	resp = post("?stream=turn", map[string]any{
+		"id":     2,
+		"method": "turn/start",
+		"params": map[string]any{"threadId": "thr_1", "script": true},
+	})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("stream: got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	done := make(chan []testFrame, 1)
+	go func() {
+		var frames []testFrame
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var frame testFrame
+			if decoder.Decode(&frame) != nil {
+				break
+			}
+			frames = append(frames, frame)
+		}
+		done <- frames
+	}()
+
+	var frames []testFrame
+	select {
+	case frames = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream did not end after turn/completed")
+	}
+	var names []string
+	for _, frame := range frames {
+		names = append(names, string(frame.Kind)+":"+frame.Event)
+	}
+	want := []string{
+		"response:",
+		"notification:turn/started",
+		"notification:item/agentMessage/delta",
+		"serverRequest:item/commandExecution/requestApproval",
+		"notification:turn/completed",
+	}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("frames:\n got %v\nwant %v", names, want)
+	}
+}
+
+func TestRPCBatchDispatchesConcurrentlyInOrder(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	// Sent one after the other, the rendezvous requests would time out.
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{CodexBin: fakeCodex, RPCTimeout: 5 * time.Second})
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	status, body := postRPC(t, srv.URL, "client-a", []any{
+		map[string]any{"id": 1, "method": "initialize"},
+		map[string]any{"method": "initialized"},
+		map[string]any{"id": "a", "method": "rendezvous"},
+		map[string]any{"id": "b", "method": "rendezvous"},
+		42,
+		map[string]any{"id": 6, "method": "ping"},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("batch: %d %s", status, body)
+	}
+
+	var responses []struct {
+		ID     any `json:"id"`
+		Result struct {
+			Method string `json:"method"`
+		} `json:"result"`
+		Error *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	// The initialized notification gets no entry.
+	if err := json.Unmarshal(body, &responses); err != nil || len(responses) != 5 {
+		t.Fatalf("decode responses: %v (%s)", err, body)
+	}
+	for i, want := range []string{"initialize", "rendezvous", "rendezvous", "", "ping"} {
+		if responses[i].Result.Method != want {
+			t.Fatalf("response %d: got %+v, want result for %q (%s)", i, responses[i], want, body)
+		}
+	}
+	if responses[1].ID != "a" || responses[2].ID != "b" {
+		t.Fatalf("responses must keep their ids in request order: %s", body)
+	}
+	if responses[3].Error == nil || responses[3].Error.Code != rpcInvalidRequest || responses[3].ID != nil {
+		t.Fatalf("invalid element must fail alone: %s", body)
+	}
+
+	status, body = postRPC(t, srv.URL, "client-a", []any{
+		map[string]any{"method": "initialized"},
+		map[string]any{"method": "note"},
+	})
+	if status != http.StatusNoContent || len(body) != 0 {
+		t.Fatalf("a batch of notifications must get no response: %d %s", status, body)
+	}
+
+	status, _ = postRPC(t, srv.URL, "client-a", []any{})
+	if status != http.StatusBadRequest {
+		t.Fatalf("empty batch: got %d", status)
+	}
+}
+
+func TestRPCIdempotencyKeyJoinsAndReplays(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	post := func(ctx context.Context, clientID, key string, payload any) (*http.Response, []byte, error) {
+		body, _ := json.Marshal(payload)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/rpc", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("X-Client-ID", clientID)
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, data, nil
+	}
+	slow := map[string]any{"id": 1, "method": "slow"}
+
+	// The phone gives up before codex answers...
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := post(ctx, "client-a", "k1", slow); err == nil {
+		t.Fatalf("expected the first attempt to time out")
+	}
+	// ...and its retry joins the request still in flight.
+	resp, first, err := post(context.Background(), "client-a", "k1", slow)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry must join the in-flight request: %v %+v %s", err, resp, first)
+	}
+	resp, again, err := post(context.Background(), "client-a", "k1", slow)
+	if err != nil || resp.Header.Get("Idempotent-Replayed") != "true" || string(again) != string(first) {
+		t.Fatalf("later retry must be served from the cache: %v %s", err, again)
+	}
+
+	resp, _, err = post(context.Background(), "client-a", "k1", map[string]any{"id": 2, "method": "ping"})
+	if err != nil || resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("reusing a key for another request must fail: %v %+v", err, resp)
+	}
+	resp, _, err = post(context.Background(), "client-b", "k1", slow)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("keys are per client: %v %+v", err, resp)
+	}
+
+	ch, stop := manager.Events("client-a").SubscribeFrom(0)
+	defer stop()
+	sent := 0
+	for done := false; !done; {
+		select {
+		case evt := <-ch:
+			if evt.Kind == events.KindResponse && evt.Method == "slow" {
+				sent++
+			}
+		case <-time.After(200 * time.Millisecond):
+			done = true
+		}
+	}
+	if sent != 1 {
+		t.Fatalf("codex must see the request once, saw %d", sent)
+	}
+}
+
+func TestIdempotencyCacheBoundsResponseBytes(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute)
+	calls := 0
+	serveBody := func(size int) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, _ *http.Request) {
+			calls++
+			_, _ = w.Write(bytes.Repeat([]byte("x"), size))
+		}
+	}
+	do := func(key string, size int) {
+		req := httptest.NewRequest(http.MethodPost, "/rpc", nil)
+		cache.serve(httptest.NewRecorder(), req, "client-a", key, []byte(key), serveBody(size))
+	}
+
+	do("big", maxIdempotentResponseBytes+1)
+	do("big", maxIdempotentResponseBytes+1)
+	if calls != 2 {
+		t.Fatalf("oversized response was cached: %d calls", calls)
+	}
+
+	// Fill the byte budget; the oldest response is dropped first.
+	n := maxIdempotencyBytes / maxIdempotentResponseBytes
+	for i := range n + 1 {
+		do(strings.Repeat("k", i+1), maxIdempotentResponseBytes)
+	}
+	if cache.bytes > maxIdempotencyBytes || len(cache.expiring) != n {
+		t.Fatalf("cache holds %d bytes in %d responses", cache.bytes, len(cache.expiring))
+	}
+	calls = 0
+	do("k", maxIdempotentResponseBytes)
+	do(strings.Repeat("k", n+1), maxIdempotentResponseBytes)
+	if calls != 1 {
+		t.Fatalf("expected only the oldest response to be evicted, got %d calls", calls)
+	}
+}
+
+func TestIdempotencyKeyRemembersTimeouts(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{CodexBin: fakeCodex, RPCTimeout: 50 * time.Millisecond})
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	post := func() (*http.Response, []byte) {
+		body, _ := json.Marshal(map[string]any{"id": 1, "method": "slow"})
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/rpc", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("X-Client-ID", "client-a")
+		req.Header.Set("Idempotency-Key", "k1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("do request: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, data
+	}
+
+	// Codex got the request; the bridge only stopped waiting for it.
+	resp, first := post()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the request to time out: %d %s", resp.StatusCode, first)
+	}
+	resp, again := post()
+	if resp.Header.Get("Idempotent-Replayed") != "true" || string(again) != string(first) {
+		t.Fatalf("a retry after a timeout must not reach codex again: %d %s", resp.StatusCode, again)
+	}
+}
+
+func TestIdempotencyCacheRetriesWhatNeverReachedCodex(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute)
+	calls := 0
+	do := func(key string, serve func(http.ResponseWriter, *http.Request)) {
+		req := httptest.NewRequest(http.MethodPost, "/rpc", nil)
+		cache.serve(httptest.NewRecorder(), req, "client-a", key, []byte(key), func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			serve(w, r)
+		})
+	}
+
+	unstarted := func(w http.ResponseWriter, _ *http.Request) { writeManagerError(w, codex.ErrMaxSessions) }
+	do("k1", unstarted)
+	do("k1", unstarted)
+	if calls != 2 {
+		t.Fatalf("a request that never reached codex must be retried, got %d calls", calls)
+	}
+	failed := func(w http.ResponseWriter, _ *http.Request) { writeRPCError(w, errors.New("rpc timed out")) }
+	do("k2", failed)
+	do("k2", failed)
+	if calls != 3 {
+		t.Fatalf("a request codex may have seen must not be retried, got %d calls", calls)
+	}
+}
+
+func TestIdempotencyCacheKeepsInFlightCallsOutOfTheBudget(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute)
+	ok := func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("ok")) }
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		req := httptest.NewRequest(http.MethodPost, "/rpc", nil)
+		cache.serve(httptest.NewRecorder(), req, "client-a", "running", []byte("running"), func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			ok(w, r)
+		})
+	}()
+	<-started
+
+	for i := range maxIdempotencyEntries {
+		req := httptest.NewRequest(http.MethodPost, "/rpc", nil)
+		key := fmt.Sprintf("k%d", i)
+		cache.serve(httptest.NewRecorder(), req, "client-a", key, []byte(key), ok)
+	}
+	cache.mu.Lock()
+	kept, running := len(cache.expiring), cache.entries[idempotencyKey{clientKey: "client-a", key: "running"}]
+	cache.mu.Unlock()
+	if kept != maxIdempotencyEntries || running == nil {
+		t.Fatalf("in-flight call must not count against the budget: %d responses kept, in flight %v", kept, running != nil)
+	}
+	close(release)
+	<-finished
+}
@@ -3,6 +3,7 @@ package httpx
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -61,8 +62,8 @@ func TestSSEReplayUsesLastEventIDHeader(t *testing.T) {
 	manager := codex.NewManager("false")
 	clientKey := "client-2"
 	hub := manager.Events(clientKey)
-	hub.Publish(events.Event{Type: "test", Data: "one"})
-	hub.Publish(events.Event{Type: "test", Data: "two"})
+	hub.Publish(events.Event{Type: "test", Data: json.RawMessage("one")})
+	hub.Publish(events.Event{Type: "test", Data: json.RawMessage("two")})
 
 	handler := NewHandler(manager, identity.Static{Key: clientKey})
 	srv := httptest.NewServer(handler)
@@ -109,3 +110,209 @@ func TestSSEReplayUsesLastEventIDHeader(t *testing.T) {
 		t.Fatalf("did not observe replayed event id=2 data=two (seenID=%v)", seenID)
 	}
 }
+
+func TestEventsFiltersByThreadAndMethod(t *testing.T) {
+	manager := codex.NewManager("false")
+	clientKey := "client-3"
+	hub := manager.Events(clientKey)
+	hub.Publish(events.Event{Type: "codex/stdout", Data: json.RawMessage("other-thread"), ThreadID: "thr_2", Method: "item/agentMessage/delta"})
+	hub.Publish(events.Event{Type: "codex/stdout", Data: json.RawMessage("excluded"), ThreadID: "thr_1", Method: "turn/diff/updated"})
+	hub.Publish(events.Event{Type: "codex/stdout", Data: json.RawMessage("wrong-method"), ThreadID: "thr_1", Method: "account/updated"})
+	hub.Publish(events.Event{Type: "codex/stdout", Data: json.RawMessage("delta"), ThreadID: "thr_1", Method: "item/agentMessage/delta"})
+	hub.Publish(events.Event{Type: "turn/started", Data: json.RawMessage("unscoped")})
+	hub.Publish(events.Event{Type: "test", Data: json.RawMessage("end")})
+
+	handler := NewHandler(manager, identity.Static{Key: clientKey})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events?threadId=thr_1&method=item/,turn/,test&exclude=turn/diff", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data: ") && !strings.HasPrefix(line, "data: {") {
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+		if line == "data: end" {
+			break
+		}
+	}
+	want := []string{"delta", "unscoped", "end"}
+	if strings.Join(data, ",") != strings.Join(want, ",") {
+		t.Fatalf("delivered %v, want %v", data, want)
+	}
+}
+
+func TestSSEReplaySurvivesRestartWithEventStore(t *testing.T) {
+	dir := t.TempDir()
+	clientKey := "client-3"
+
+	first := codex.NewManagerWithOptions(codex.ManagerOptions{CodexBin: "false", EventStoreDir: dir})
+	hub := first.Events(clientKey)
+	hub.Publish(events.Event{Type: "test", Data: json.RawMessage(`"one"`)})
+	hub.Publish(events.Event{Type: "test", Data: json.RawMessage(`"two"`)})
+	epoch := hub.Epoch()
+	if err := first.Close(context.Background()); err != nil {
+		t.Fatalf("close first manager: %v", err)
+	}
+
+	manager := codex.NewManagerWithOptions(codex.ManagerOptions{CodexBin: "false", EventStoreDir: dir})
+	if got := manager.Events(clientKey).Epoch(); got != epoch {
+		t.Fatalf("epoch after restart: got %q, want %q", got, epoch)
+	}
+	srv := httptest.NewServer(NewHandler(manager, identity.Static{Key: clientKey}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events?v=2", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Last-Event-ID", epoch+"-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "event: session/gap" {
+			t.Fatalf("unexpected gap when resuming from the same epoch")
+		}
+		if line == "id: "+epoch+"-2" {
+			return
+		}
+	}
+	t.Fatalf("did not observe replayed event id %s-2 (err=%v)", epoch, scanner.Err())
+}
+
+func TestEventsCoalescesDeltasPerItem(t *testing.T) {
+	manager := codex.NewManager("false")
+	clientKey := "client-4"
+	hub := manager.Events(clientKey)
+	delta := func(itemID, text string) {
+		hub.Publish(events.Event{
+			Type:     "codex/stdout",
+			Kind:     events.KindNotification,
+			Method:   "item/agentMessage/delta",
+			ThreadID: "thr_1",
+			ItemID:   itemID,
+			Data:     json.RawMessage(`{"method":"item/agentMessage/delta","params":{"threadId":"thr_1","itemId":"` + itemID + `","delta":"` + text + `"}}`),
+		})
+	}
+	delta("msg_1", "Hel")
+	delta("msg_2", "x")
+	delta("msg_1", "lo")
+	hub.Publish(events.Event{Type: "codex/stdout", Kind: events.KindNotification, Method: "turn/completed", ThreadID: "thr_1", Data: json.RawMessage(`{"method":"turn/completed"}`)})
+
+	srv := httptest.NewServer(NewHandler(manager, identity.Static{Key: clientKey}))
+	defer srv.Close()
+
+	bad, err := http.Get(srv.URL + "/events?coalesce=soon")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	bad.Body.Close()
+	if bad.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid coalesce: got %d, want 400", bad.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events?coalesce=50ms", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	type frame struct{ id, data string }
+	var frames []frame
+	var current frame
+	scanner := bufio.NewScanner(resp.Body)
+	for len(frames) < 4 && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			current.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			frames = append(frames, current)
+			current = frame{}
+		}
+	}
+	if len(frames) != 4 {
+		t.Fatalf("got %d frames (err=%v)", len(frames), scanner.Err())
+	}
+
+	// frames[0] is the snapshot. Both items' deltas go out merged, with only
+	// the last carrying an id, then the turn event.
+	if f := frames[1]; f.id != "" || !strings.Contains(f.data, `"delta":"Hello"`) {
+		t.Fatalf("merged delta: %+v", f)
+	}
+	if f := frames[2]; f.id != "3" || !strings.Contains(f.data, `"delta":"x"`) {
+		t.Fatalf("second item: %+v", f)
+	}
+	if f := frames[3]; f.id != "4" || !strings.Contains(f.data, "turn/completed") {
+		t.Fatalf("turn event: %+v", f)
+	}
+}
+
+func TestNonJSONStdoutIsRawOnV1AndQuotedOnV2(t *testing.T) {
+	line := `warning: "odd" output`
+	quoted, _ := json.Marshal(line)
+	evt := events.Event{ID: 3, Type: codexStdoutEvent, Kind: events.KindBridge, Data: quoted}
+
+	var v1 strings.Builder
+	writeSSE(&v1, streamEvent(evt, streamV1, "e"))
+	if want := "id: 3\nevent: codex/stdout\ndata: " + line + "\n\n"; v1.String() != want {
+		t.Fatalf("v1: got %q, want %q", v1.String(), want)
+	}
+
+	var v2 strings.Builder
+	writeSSE(&v2, streamEvent(evt, streamV2, "e"))
+	if !strings.Contains(v2.String(), `"payload":`+string(quoted)) {
+		t.Fatalf("v2 must quote the line: %q", v2.String())
+	}
+}
+
+func TestElisionIsOnlySentOnV2(t *testing.T) {
+	full := `{"method":"item/completed","params":{"item":{"aggregatedOutput":"` + strings.Repeat("x", 64) + `"}}}`
+	elided := `{"method":"item/completed","params":{"item":{"aggregatedOutput":{"elided":true,"bytes":64,"ref":"abc"}}}}`
+	evt := events.Event{ID: 4, Type: codexStdoutEvent, Kind: events.KindNotification, Method: "item/completed", Data: json.RawMessage(full), Elided: json.RawMessage(elided)}
+
+	var v1 strings.Builder
+	writeSSE(&v1, streamEvent(evt, streamV1, "e"))
+	if !strings.Contains(v1.String(), "data: "+full+"\n") {
+		t.Fatalf("v1 must send the whole line: %q", v1.String())
+	}
+
+	var v2 strings.Builder
+	writeSSE(&v2, streamEvent(evt, streamV2, "e"))
+	if !strings.Contains(v2.String(), `"payload":`+elided) {
+		t.Fatalf("v2 must send the elided payload: %q", v2.String())
+	}
+	if frame := frameFor(evt, "e"); string(frame.Payload) != elided {
+		t.Fatalf("frames must carry the elided payload: %s", frame.Payload)
+	}
+}
@@ -0,0 +1,173 @@
+package httpx
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"climate/server/internal/codex"
+	"climate/server/internal/events"
+	"climate/server/internal/identity"
+	"github.com/coder/websocket"
+)
+
+type testFrame struct {
+	ID       string          `json:"id"`
+	Event    string          `json:"event"`
+	Kind     events.Kind     `json:"kind"`
+	Method   string          `json:"method"`
+	ThreadID string          `json:"threadId"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+func dialWS(t *testing.T, ctx context.Context, baseURL, clientID, query string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(baseURL, "http") + "/ws" + query
+	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader: http.Header{"X-Client-ID": []string{clientID}},
+	})
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	return conn
+}
+
+func readWSFrame(t *testing.T, ctx context.Context, conn *websocket.Conn) testFrame {
+	t.Helper()
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	var frame testFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("decode frame: %v (%s)", err, data)
+	}
+	return frame
+}
+
+func writeWSMessage(t *testing.T, ctx context.Context, conn *websocket.Conn, msg any) {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("encode message: %v", err)
+	}
+	if err := conn.Write(ctx, websocket.MessageText, data); err != nil {
+		t.Fatalf("write message: %v", err)
+	}
+}
+
+func TestWSCarriesRPCAndEventsInOrder(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandler(manager, identity.Header{HeaderName: "X-Client-ID"})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn := dialWS(t, ctx, srv.URL, "client-a", "")
+	defer conn.CloseNow()
+
+	if frame := readWSFrame(t, ctx, conn); frame.Event != "session/snapshot" {
+		t.Fatalf("first frame must be the snapshot, got %+v", frame)
+	}
+
+	writeWSMessage(t, ctx, conn, map[string]any{"id": 7, "method": "streamTurn"})
+	var names []string
+	var lastID string
+	for {
+		frame := readWSFrame(t, ctx, conn)
+		if frame.Kind == events.KindResponse {
+			var resp struct {
+				ID     int `json:"id"`
+				Result struct {
+					Method string `json:"method"`
+				} `json:"result"`
+			}
+			if err := json.Unmarshal(frame.Payload, &resp); err != nil || resp.ID != 7 || resp.Result.Method != "streamTurn" {
+				t.Fatalf("unexpected response: %s", frame.Payload)
+			}
+			break
+		}
+		if frame.ID != "" {
+			lastID = frame.ID
+		}
+		names = append(names, frame.Event)
+	}
+	if len(names) == 0 || names[len(names)-1] != "thread/tokenUsage/updated" {
+		t.Fatalf("response must follow the notifications it comes after, got %v", names)
+	}
+
+	writeWSMessage(t, ctx, conn, map[string]any{"id": 8, "method": "askFirst"})
+	for {
+		frame := readWSFrame(t, ctx, conn)
+		if frame.Kind == events.KindServerRequest {
+			if frame.Method != "item/commandExecution/requestApproval" || frame.ThreadID != "thr_1" {
+				t.Fatalf("unexpected server request: %+v", frame)
+			}
+			break
+		}
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	resumed := dialWS(t, ctx, srv.URL, "client-a", "?lastEventId="+lastID)
+	defer resumed.CloseNow()
+	readWSFrame(t, ctx, resumed)
+	frame := readWSFrame(t, ctx, resumed)
+	if frame.Kind != events.KindServerRequest {
+		t.Fatalf("resume must start after %s with the approval request, got %+v", lastID, frame)
+	}
+
+	writeWSMessage(t, ctx, resumed, map[string]any{"id": 9, "method": "bogus"})
+	writeWSMessage(t, ctx, resumed, map[string]any{"method": "initialized"})
+	for {
+		frame := readWSFrame(t, ctx, resumed)
+		if frame.Kind != events.KindResponse {
+			continue
+		}
+		var resp struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(frame.Payload, &resp); err != nil || resp.ID != 9 {
+			t.Fatalf("notifications must not be answered, got %s", frame.Payload)
+		}
+		break
+	}
+}
+
+func TestWSRejectsForeignOrigins(t *testing.T) {
+	fakeCodex := buildFakeCodex(t)
+	manager := codex.NewManager(fakeCodex)
+	handler := NewHandlerWithOptions(manager, identity.Header{HeaderName: "X-Client-ID"}, Options{WSOriginPatterns: []string{"app.example.ts.net"}})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	dial := func(origin string) (*http.Response, error) {
+		header := http.Header{"X-Client-ID": []string{"client-a"}}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: header})
+		if err == nil {
+			conn.CloseNow()
+		}
+		return resp, err
+	}
+
+	resp, err := dial("https://evil.example.com")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("a foreign origin must be rejected with 403: %v", err)
+	}
+	for _, origin := range []string{"", srv.URL, "https://app.example.ts.net"} {
+		if _, err := dial(origin); err != nil {
+			t.Fatalf("origin %q must be allowed: %v", origin, err)
+		}
+	}
+}
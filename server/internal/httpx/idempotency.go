@@ -0,0 +1,187 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayHeader marks a response served from the cache or
+	// shared with an earlier request carrying the same key.
+	idempotentReplayHeader = "Idempotent-Replayed"
+
+	defaultIdempotencyTTL = 10 * time.Minute
+	maxIdempotencyKeyLen  = 255
+	// maxIdempotencyEntries and maxIdempotencyBytes bound the remembered
+	// responses per handler; the one closest to expiry is dropped first.
+	// Requests in flight do not count.
+	maxIdempotencyEntries = 4096
+	maxIdempotencyBytes   = 64 << 20
+	// maxIdempotentResponseBytes is the largest response remembered; a retry
+	// after a larger one is sent to codex again.
+	maxIdempotentResponseBytes = 4 << 20
+)
+
+type idempotencyKey struct {
+	clientKey string
+	key       string
+}
+
+// idempotentCall is one request made under an Idempotency-Key: in flight
+// until done is closed, then its response is kept until expires.
+type idempotentCall struct {
+	key         idempotencyKey
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	response    *recordedResponse
+	expires     time.Time
+}
+
+// idempotencyCache remembers /rpc responses by client and Idempotency-Key,
+// so a client that lost a response can retry without re-sending the request
+// to codex.
+type idempotencyCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[idempotencyKey]*idempotentCall
+	// expiring holds the remembered responses by expiry (the TTL is fixed,
+	// so in the order they completed); bytes is the size of their bodies.
+	expiring []*idempotentCall
+	bytes    int
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, entries: make(map[idempotencyKey]*idempotentCall)}
+}
+
+// serve answers r through serve once per key: a retry while the first
+// request is in flight waits for its response, a later one gets it from the
+// cache. Failures are remembered too, since codex may have acted on a request
+// the bridge timed out on; only when nothing reached codex (and for responses
+// too large to keep) may the key be used again. Reusing a key for a different
+// body is an error.
+func (c *idempotencyCache) serve(w http.ResponseWriter, r *http.Request, clientKey, key string, body []byte, serve func(http.ResponseWriter, *http.Request)) {
+	k := idempotencyKey{clientKey: clientKey, key: key}
+	sum := sha256.Sum256(body)
+
+	c.mu.Lock()
+	c.sweep(time.Now())
+	call := c.entries[k]
+	if call != nil && call.fingerprint != sum {
+		c.mu.Unlock()
+		writeJSONError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key was used for a different request")
+		return
+	}
+	owner := call == nil
+	if owner {
+		call = &idempotentCall{key: k, fingerprint: sum, done: make(chan struct{})}
+		c.entries[k] = call
+	}
+	c.mu.Unlock()
+
+	if owner {
+		// The request must complete even if this caller goes away: that
+		// is the retry's answer.
+		recorder := &recordedResponse{header: make(http.Header)}
+		serve(recorder, r.WithContext(context.WithoutCancel(r.Context())))
+		c.mu.Lock()
+		call.response = recorder
+		if !recorder.unsent && recorder.body.Len() <= maxIdempotentResponseBytes {
+			call.expires = time.Now().Add(c.ttl)
+			c.expiring = append(c.expiring, call)
+			c.bytes += recorder.body.Len()
+			c.sweep(time.Now())
+		} else {
+			delete(c.entries, k)
+		}
+		c.mu.Unlock()
+		close(call.done)
+		call.response.writeTo(w, false)
+		return
+	}
+
+	select {
+	case <-call.done:
+		call.response.writeTo(w, true)
+	case <-r.Context().Done():
+	}
+}
+
+// sweep drops expired responses, and the oldest ones beyond
+// maxIdempotencyEntries or maxIdempotencyBytes. Callers hold c.mu.
+func (c *idempotencyCache) sweep(now time.Time) {
+	for len(c.expiring) > 0 {
+		call := c.expiring[0]
+		if !now.After(call.expires) && len(c.expiring) <= maxIdempotencyEntries && c.bytes <= maxIdempotencyBytes {
+			return
+		}
+		c.expiring[0] = nil
+		c.expiring = c.expiring[1:]
+		c.bytes -= call.response.body.Len()
+		if c.entries[call.key] == call {
+			delete(c.entries, call.key)
+		}
+	}
+}
+
+// parseIdempotencyKey reads the Idempotency-Key header; "" means none.
+func parseIdempotencyKey(r *http.Request) (string, bool) {
+	key := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+	return key, len(key) <= maxIdempotencyKeyLen
+}
+
+// recordedResponse captures a handler's response so it can be replayed.
+type recordedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	// unsent is set when the request never reached codex.
+	unsent bool
+}
+
+// markUnsent notes on w, if it is recording a response for an
+// Idempotency-Key, that the request never reached codex and may be retried.
+func markUnsent(w http.ResponseWriter) {
+	if recorder, ok := w.(*recordedResponse); ok {
+		recorder.unsent = true
+	}
+}
+
+func (r *recordedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *recordedResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *recordedResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+func (r *recordedResponse) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *recordedResponse) writeTo(w http.ResponseWriter, replayed bool) {
+	for key, values := range r.header {
+		w.Header()[key] = values
+	}
+	if replayed {
+		w.Header().Set(idempotentReplayHeader, "true")
+	}
+	w.WriteHeader(r.statusCode())
+	_, _ = w.Write(r.body.Bytes())
+}
@@ -0,0 +1,170 @@
+package httpx
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"climate/server/internal/events"
+)
+
+const (
+	defaultPollWait = 25 * time.Second
+	maxPollWait     = 60 * time.Second
+	// maxPollEvents bounds one poll response; the rest waits for the next.
+	// The events replayed after a gap all go out with it, whatever their
+	// number (at most the hub's capacity).
+	maxPollEvents = 256
+	// pollLinger is how long a poll that has something to return waits for
+	// more.
+	pollLinger = 20 * time.Millisecond
+
+	// pollCursorHeader is the position to pass as `after` next time. It can
+	// be past the last event returned when filtered-out events followed it.
+	pollCursorHeader = "X-Climate-Cursor"
+)
+
+// handleEventsPoll is the long-poll fallback for /events: it answers with a
+// JSON array of streamFrames as soon as at least one event passes the
+// filters, or an empty array after `wait` (`wait=0s` returns what is already
+// there). Filters and session/gap events work as on the SSE stream; a poll
+// without `after` starts, like a fresh SSE connection, with the
+// session/snapshot.
+func (s *Server) handleEventsPoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	clientKey, err := s.identity.ClientKey(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	from := parseLastEventID(r)
+	after := strings.TrimSpace(query.Get("after"))
+	if after != "" {
+		pos, err := events.ParsePosition(after)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "invalid after")
+			return
+		}
+		from = pos
+	}
+	wait := defaultPollWait
+	if value := strings.TrimSpace(query.Get("wait")); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || d > maxPollWait {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("wait must be a duration between 0s and %s", maxPollWait))
+			return
+		}
+		wait = d
+	}
+	filter := parseEventFilter(query)
+	if filter.include[codexStderrEvent] {
+		release := s.manager.WatchStderr(clientKey)
+		defer release()
+	}
+
+	hub := s.manager.Events(clientKey)
+	ch, cancel := hub.Resume(from)
+	defer cancel()
+
+	frames := []streamFrame{}
+	if after == "" && r.Header.Get("Last-Event-ID") == "" {
+		snap, err := json.Marshal(s.manager.Snapshot(clientKey))
+		if err != nil {
+			snap = []byte("null")
+		}
+		frames = append(frames, frameFor(events.Event{Type: "session/snapshot", Kind: events.KindBridge, Data: snap}, hub.Epoch()))
+	}
+
+	cursor := from
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	linger := time.NewTimer(pollLinger)
+	linger.Stop()
+	defer linger.Stop()
+	// Block until something passes the filters, then take whatever else
+	// arrives without a pause.
+	deadline := timeout.C
+	if len(frames) > 0 || wait == 0 {
+		linger.Reset(pollLinger)
+		deadline = linger.C
+	}
+	// replayTo is the end of an evicted gap whose retained events are being
+	// replayed. They are sent in the same response as the gap, so the cursor
+	// can move past it and the next poll does not report it again.
+	var replayTo uint64
+collect:
+	for len(frames) < maxPollEvents || replayTo != 0 {
+		var evt events.Event
+		var ok bool
+		pause := deadline
+		if replayTo != 0 {
+			pause = nil
+		}
+		select {
+		case evt, ok = <-ch:
+		case <-pause:
+			break collect
+		case <-r.Context().Done():
+			return
+		}
+		if !ok {
+			break collect
+		}
+		if evt.ID > replayTo {
+			replayTo = 0
+		}
+		cursor = pollCursor(cursor, evt, hub.Epoch())
+		if evt.Type == events.GapEventType {
+			log.Printf("[events] client=%s poll gap: %s", clientKey, evt.Data)
+			var gap events.Gap
+			if json.Unmarshal(evt.Data, &gap) == nil && gap.Reason == events.GapEvicted {
+				replayTo = gap.To
+			}
+		}
+		if filter.allows(evt) {
+			frames = append(frames, frameFor(evt, hub.Epoch()))
+			linger.Reset(pollLinger)
+			deadline = linger.C
+		}
+	}
+
+	if cursor != (events.Position{}) {
+		w.Header().Set(pollCursorHeader, cursor.String())
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, frames)
+}
+
+// pollCursor advances the cursor past evt. An evicted gap goes out together
+// with its replay, so the cursor moves past it (and the retained events
+// replayed from inside it do not move it back). After a reset the next poll
+// must see the whole new log, and after an overflow what is retained from
+// gap.From on, so the cursor moves to just before them.
+func pollCursor(cursor events.Position, evt events.Event, epoch string) events.Position {
+	if evt.ID != 0 {
+		if cursor.Epoch == epoch && evt.ID <= cursor.ID {
+			return cursor
+		}
+		return events.Position{Epoch: epoch, ID: evt.ID}
+	}
+	var gap events.Gap
+	if evt.Type != events.GapEventType || json.Unmarshal(evt.Data, &gap) != nil {
+		return cursor
+	}
+	switch gap.Reason {
+	case events.GapReset:
+		return events.Position{Epoch: epoch}
+	case events.GapEvicted:
+		return events.Position{Epoch: epoch, ID: gap.To}
+	}
+	return events.Position{Epoch: epoch, ID: gap.From - 1}
+}
@@ -0,0 +1,142 @@
+package httpx
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"climate/server/internal/codex"
+	"climate/server/internal/events"
+)
+
+// sessionExitedEvent ends every turn stream: the turn died with codex.
+const sessionExitedEvent = "session/exited"
+
+// turnScope selects the events of one turn for POST /rpc?stream=turn.
+type turnScope struct {
+	threadID string
+	turnID   string
+}
+
+// turnParams holds the params that tie a notification to a turn.
+type turnParams struct {
+	TurnID string `json:"turnId"`
+	Turn   struct {
+		ID string `json:"id"`
+	} `json:"turn"`
+}
+
+// streamTurn answers POST /rpc?stream=turn with NDJSON streamFrames: the
+// response, then every notification, server request and bridge event of the
+// turn the request started, ending after turn/completed. A request whose
+// result holds no turn gets just the response.
+func (s *Server) streamTurn(w http.ResponseWriter, r *http.Request, clientKey string, session *codex.Session, payload map[string]any) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming_unsupported", "streaming unsupported")
+		return
+	}
+
+	// Subscribe first: codex may announce the turn before answering.
+	hub := s.manager.Events(clientKey)
+	ch, cancel := hub.Resume(events.Position{Epoch: hub.Epoch(), ID: hub.HighWaterMark()})
+	defer cancel()
+
+	response, err := session.SendRPC(r.Context(), payload)
+	if err != nil {
+		writeRPCError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	encoder := json.NewEncoder(w)
+	_ = encoder.Encode(streamFrame{streamEnvelope: streamEnvelope{Kind: events.KindResponse, Payload: response}})
+	flusher.Flush()
+
+	scope := turnScope{threadID: paramString(payload, "threadId"), turnID: responseTurnID(response)}
+	if scope.turnID == "" {
+		return
+	}
+	log.Printf("[rpc] client=%s streaming turn %s", clientKey, scope.turnID)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt, ok := <-ch:
+			if !ok {
+				return
+			}
+			match, done := scope.matches(evt)
+			if !match {
+				continue
+			}
+			if err := encoder.Encode(frameFor(evt, hub.Epoch())); err != nil {
+				return
+			}
+			flusher.Flush()
+			if done {
+				return
+			}
+		}
+	}
+}
+
+// matches reports whether evt belongs to the turn, and whether it is the
+// last event of the stream.
+func (t turnScope) matches(evt events.Event) (match, done bool) {
+	switch {
+	case evt.Type == events.GapEventType:
+		return true, false
+	case evt.Type == sessionExitedEvent:
+		return true, true
+	case evt.Kind == events.KindResponse:
+		return false, false
+	case t.threadID != "" && evt.ThreadID != t.threadID:
+		return false, false
+	case evt.Kind == events.KindBridge:
+		return evt.ThreadID != "", false
+	}
+
+	var msg struct {
+		Params turnParams `json:"params"`
+	}
+	if json.Unmarshal(evt.Data, &msg) != nil {
+		return false, false
+	}
+	turnID := msg.Params.TurnID
+	if turnID == "" {
+		turnID = msg.Params.Turn.ID
+	}
+	if turnID == "" {
+		// Thread-scoped, but not tied to a turn.
+		return t.threadID != "", false
+	}
+	if turnID != t.turnID {
+		return false, false
+	}
+	return true, evt.Method == "turn/completed"
+}
+
+// responseTurnID returns result.turn.id of a JSON-RPC response.
+func responseTurnID(response []byte) string {
+	var resp struct {
+		Result struct {
+			Turn struct {
+				ID string `json:"id"`
+			} `json:"turn"`
+		} `json:"result"`
+	}
+	if json.Unmarshal(response, &resp) != nil {
+		return ""
+	}
+	return resp.Result.Turn.ID
+}
+
+func paramString(payload map[string]any, key string) string {
+	params, _ := payload["params"].(map[string]any)
+	value, _ := params[key].(string)
+	return value
+}
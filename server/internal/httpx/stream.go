@@ -0,0 +1,117 @@
+package httpx
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"climate/server/internal/events"
+)
+
+// /events stream versions. Clients opt into a newer one with `?v=N` or the
+// X-Climate-Stream-Version request header; the version actually used is
+// echoed in the response header.
+const (
+	// streamV1 sends codex output as `event: codex/stdout` with the raw
+	// JSON-RPC line as data, and bridge events under their own type.
+	streamV1 = 1
+	// streamV2 names each event after its JSON-RPC method (bridge events keep
+	// their type), sends a streamEnvelope as data and ids as "<epoch>-<id>".
+	// Large strings in the payload are replaced by blob references.
+	streamV2 = 2
+
+	latestStreamVersion = streamV2
+	streamVersionHeader = "X-Climate-Stream-Version"
+)
+
+// streamEnvelope is the data of a v2 event: the classification lets clients
+// dispatch without sniffing the JSON-RPC message.
+type streamEnvelope struct {
+	Kind     events.Kind     `json:"kind"`
+	Method   string          `json:"method,omitempty"`
+	ThreadID string          `json:"threadId,omitempty"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// streamFrame is an event as a standalone JSON value, for transports other
+// than SSE (/ws, /events/poll): its position as id, its v2 name as event and
+// the v2 envelope. On /ws, responses to the socket's own requests are frames
+// of kind "response" with the JSON-RPC response as payload.
+type streamFrame struct {
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	streamEnvelope
+}
+
+func negotiateStreamVersion(r *http.Request) int {
+	value := strings.TrimSpace(r.URL.Query().Get("v"))
+	if value == "" {
+		value = strings.TrimSpace(r.Header.Get(streamVersionHeader))
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < streamV1 {
+		return streamV1
+	}
+	return min(n, latestStreamVersion)
+}
+
+func streamEvent(evt events.Event, version int, epoch string) SSEEvent {
+	if version < streamV2 {
+		return SSEEvent{ID: evt.ID, Type: evt.Type, Data: v1Data(evt)}
+	}
+	name, envelope := envelopeFor(evt)
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		log.Printf("[events] failed to encode event %d (%s): %v", evt.ID, evt.Type, err)
+		return SSEEvent{ID: evt.ID, Type: evt.Type, Data: evt.Data}
+	}
+	return SSEEvent{ID: evt.ID, Epoch: epoch, Type: name, Data: data}
+}
+
+// v1Data is the data of a v1 event: the line as codex wrote it, never
+// elided. Codex output that is not JSON is kept on the hub as a JSON string.
+func v1Data(evt events.Event) any {
+	if evt.Type == codexStdoutEvent && evt.Kind == events.KindBridge {
+		var line string
+		if json.Unmarshal(evt.Data, &line) == nil {
+			return line
+		}
+	}
+	return evt.Data
+}
+
+// envelopeFor returns the v2 name and envelope of evt.
+func envelopeFor(evt events.Event) (string, streamEnvelope) {
+	kind := evt.Kind
+	if kind == "" {
+		kind = events.KindBridge
+	}
+	name := evt.Type
+	if kind != events.KindBridge && evt.Method != "" {
+		name = evt.Method
+	}
+	payload := evt.Data
+	if len(evt.Elided) > 0 {
+		payload = evt.Elided
+	}
+	if len(payload) == 0 {
+		payload = json.RawMessage("null")
+	}
+	return name, streamEnvelope{
+		Kind:     kind,
+		Method:   evt.Method,
+		ThreadID: evt.ThreadID,
+		Payload:  payload,
+	}
+}
+
+func frameFor(evt events.Event, epoch string) streamFrame {
+	name, envelope := envelopeFor(evt)
+	frame := streamFrame{Event: name, streamEnvelope: envelope}
+	if evt.ID != 0 {
+		frame.ID = events.Position{Epoch: epoch, ID: evt.ID}.String()
+	}
+	return frame
+}
@@ -0,0 +1,258 @@
+package httpx
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"climate/server/internal/events"
+	"github.com/coder/websocket"
+)
+
+const (
+	wsPingInterval = 15 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	// wsMaxInFlight bounds the requests one socket has waiting on codex;
+	// reading pauses beyond it.
+	wsMaxInFlight = 32
+	// wsResponseHold is how long a response waits for the events published
+	// before it to be sent first.
+	wsResponseHold = time.Second
+)
+
+// wsResult is the outcome of a request read from the socket.
+type wsResult struct {
+	data json.RawMessage
+	// after is the last event published when codex answered: the response
+	// is held until the stream has caught up with it.
+	after    uint64
+	deadline time.Time
+}
+
+// handleWS carries JSON-RPC in both directions over one WebSocket: the
+// client sends what it would POST to /rpc (requests, notifications and
+// answers to approval requests), and receives streamFrames: responses to its
+// requests in order with the /events stream, which takes the same filters. Resume with
+// `?lastEventId=` (or Last-Event-ID) set to the last event id received.
+//
+// Responses are sent to the requesting socket only, so the hub's response
+// events are not forwarded.
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	clientKey, err := s.identity.ClientKey(r)
+	if err != nil {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return
+	}
+
+	from := parseLastEventID(r)
+	if value := strings.TrimSpace(r.URL.Query().Get("lastEventId")); value != "" {
+		pos, err := events.ParsePosition(value)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "invalid lastEventId")
+			return
+		}
+		from = pos
+	}
+	filter := parseEventFilter(r.URL.Query())
+
+	// Browsers let any page open a WebSocket, so unlike CORS-guarded /rpc
+	// the origin is checked: native clients send none, browsers must be on
+	// this host or one of wsOriginPatterns.
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: s.wsOriginPatterns})
+	if err != nil {
+		log.Printf("[ws] client=%s upgrade failed: %v", clientKey, err)
+		return
+	}
+	conn.SetReadLimit(s.maxBodyBytes)
+	defer conn.CloseNow()
+
+	if filter.include[codexStderrEvent] {
+		release := s.manager.WatchStderr(clientKey)
+		defer release()
+	}
+	hub := s.manager.Events(clientKey)
+	ch, cancel := hub.Resume(from)
+	defer cancel()
+
+	log.Printf("[ws] client=%s connected (from=%s)", clientKey, from)
+	defer log.Printf("[ws] client=%s disconnected", clientKey)
+
+	ctx, stop := context.WithCancel(r.Context())
+	defer stop()
+	results := make(chan wsResult)
+	go func() {
+		defer stop()
+		s.readWS(ctx, conn, clientKey, hub, results)
+	}()
+
+	snap, err := json.Marshal(s.manager.Snapshot(clientKey))
+	if err != nil {
+		snap = []byte("null")
+	}
+	if !writeWS(ctx, conn, frameFor(events.Event{Type: "session/snapshot", Kind: events.KindBridge, Data: snap}, hub.Epoch())) {
+		return
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	hold := time.NewTimer(wsResponseHold)
+	hold.Stop()
+	defer hold.Stop()
+
+	var seen uint64
+	var held []wsResult
+	release := func(force bool) bool {
+		kept := held[:0]
+		for _, res := range held {
+			if !force && res.after > seen && time.Now().Before(res.deadline) {
+				kept = append(kept, res)
+				continue
+			}
+			if !writeWS(ctx, conn, streamFrame{streamEnvelope: streamEnvelope{Kind: events.KindResponse, Payload: res.data}}) {
+				return false
+			}
+		}
+		held = kept
+		if len(held) > 0 {
+			hold.Reset(time.Until(held[0].deadline))
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			pingCtx, cancelPing := context.WithTimeout(ctx, wsWriteTimeout)
+			err := conn.Ping(pingCtx)
+			cancelPing()
+			if err != nil {
+				return
+			}
+		case <-hold.C:
+			if !release(false) {
+				return
+			}
+		case res := <-results:
+			held = append(held, res)
+			if !release(false) {
+				return
+			}
+		case evt, ok := <-ch:
+			if !ok {
+				release(true)
+				conn.Close(websocket.StatusGoingAway, "event stream closed")
+				return
+			}
+			seen = max(seen, evt.ID)
+			if evt.Type == events.GapEventType {
+				log.Printf("[ws] client=%s stream gap: %s", clientKey, evt.Data)
+			}
+			if evt.Kind != events.KindResponse && filter.allows(evt) {
+				if !writeWS(ctx, conn, frameFor(evt, hub.Epoch())) {
+					return
+				}
+			}
+			if !release(false) {
+				return
+			}
+		}
+	}
+}
+
+// readWS forwards each message read from the socket to codex, and hands
+// responses to requests back to the writer through results.
+func (s *Server) readWS(ctx context.Context, conn *websocket.Conn, clientKey string, hub *events.Hub, results chan<- wsResult) {
+	inFlight := make(chan struct{}, wsMaxInFlight)
+	for {
+		typ, data, err := conn.Read(ctx)
+		if err != nil {
+			if status := websocket.CloseStatus(err); status == -1 && ctx.Err() == nil {
+				log.Printf("[ws] client=%s read failed: %v", clientKey, err)
+			}
+			return
+		}
+		if typ != websocket.MessageText {
+			s.sendWSResult(ctx, results, rpcError(nil, rpcInvalidRequest, "expected a text message"), hub)
+			continue
+		}
+		payload, err := decodeJSON(data)
+		if err != nil {
+			s.sendWSResult(ctx, results, rpcError(nil, rpcParseError, "invalid json"), hub)
+			continue
+		}
+
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		go func() {
+			defer func() { <-inFlight }()
+			resp := s.forwardWS(ctx, clientKey, payload)
+			if resp != nil {
+				s.sendWSResult(ctx, results, resp, hub)
+			}
+		}()
+	}
+}
+
+// forwardWS sends one client message to codex. It returns the response to
+// send back, or nil for notifications and answers to codex's requests.
+func (s *Server) forwardWS(ctx context.Context, clientKey string, payload map[string]any) json.RawMessage {
+	id, hasID := payload["id"]
+	method, _ := payload["method"].(string)
+	isRequest := hasID && method != ""
+	if method != "" {
+		log.Printf("[ws] client=%s method=%s", clientKey, method)
+	}
+
+	session, err := s.manager.Ensure(clientKey)
+	if err == nil {
+		var resp []byte
+		resp, err = session.SendRPC(ctx, payload)
+		if err == nil {
+			if !isRequest {
+				return nil
+			}
+			return resp
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	log.Printf("[ws] client=%s method=%s failed: %v", clientKey, method, err)
+	if !isRequest {
+		// Nothing to correlate a response with; say so with a null id.
+		id = nil
+	}
+	return rpcErrorFor(id, err)
+}
+
+func (s *Server) sendWSResult(ctx context.Context, results chan<- wsResult, data json.RawMessage, hub *events.Hub) {
+	res := wsResult{data: data, after: hub.HighWaterMark(), deadline: time.Now().Add(wsResponseHold)}
+	select {
+	case results <- res:
+	case <-ctx.Done():
+	}
+}
+
+func writeWS(ctx context.Context, conn *websocket.Conn, frame streamFrame) bool {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("[ws] failed to encode frame (%s): %v", frame.Event, err)
+		return true
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, wsWriteTimeout)
+	defer cancel()
+	return conn.Write(writeCtx, websocket.MessageText, data) == nil
+}
@@ -0,0 +1,281 @@
+package policy
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	DecisionAccept  = "accept"
+	DecisionDecline = "decline"
+
+	KindCommand    = "command"
+	KindFileChange = "fileChange"
+)
+
+// Config is the `policy` section of the server config.
+type Config struct {
+	Rules []Rule `mapstructure:"rules"`
+}
+
+// Rule auto-answers approvals it matches. Every non-empty matcher must match;
+// patterns are globs where `*` matches any run of characters (including `/`).
+//
+// For accept rules, Commands and Paths must match every command / changed
+// path in the request, so `go test *` does not approve
+// `go test ./... && rm -rf ~`. In accept command patterns `*` never matches
+// shell metacharacters or newlines, and a request whose raw command contains
+// any is never accepted, nor is one whose raw command is unknown. Decline
+// rules fire if any of them match, including the raw command.
+//
+// Cwd and Paths are matched after filepath.Clean, so `/src/*` does not
+// approve `/src/../etc`; accept rules never match relative paths or paths
+// that still climb with `..`.
+type Rule struct {
+	Name     string   `mapstructure:"name"`
+	Decision string   `mapstructure:"decision"`
+	Kind     string   `mapstructure:"kind"`
+	Reason   string   `mapstructure:"reason"`
+	Commands []string `mapstructure:"commands"`
+	Cwd      []string `mapstructure:"cwd"`
+	Paths    []string `mapstructure:"paths"`
+	Threads  []string `mapstructure:"threads"`
+	Clients  []string `mapstructure:"clients"`
+}
+
+// Request describes an approval request as seen by the bridge.
+type Request struct {
+	Kind      string
+	ClientKey string
+	ThreadID  string
+	Cwd       string
+	// Commands are the parsed commands; accept rules only match on these.
+	Commands []string
+	// Command is the command line codex will run, if known.
+	Command string
+	Paths   []string
+}
+
+type Decision struct {
+	Decision string `json:"decision"`
+	Rule     string `json:"rule"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type Engine struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	commands []*regexp.Regexp
+	cwd      []*regexp.Regexp
+	paths    []*regexp.Regexp
+	threads  []*regexp.Regexp
+	clients  []*regexp.Regexp
+}
+
+// New compiles cfg. It returns a nil Engine (which never decides anything)
+// when no rules are configured.
+func New(cfg Config) (*Engine, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	engine := &Engine{rules: make([]compiledRule, 0, len(cfg.Rules))}
+	for i, rule := range cfg.Rules {
+		if strings.TrimSpace(rule.Name) == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		switch rule.Decision {
+		case DecisionAccept, DecisionDecline:
+		default:
+			return nil, fmt.Errorf("policy rule %q: decision must be %q or %q", rule.Name, DecisionAccept, DecisionDecline)
+		}
+		switch rule.Kind {
+		case "", KindCommand, KindFileChange:
+		default:
+			return nil, fmt.Errorf("policy rule %q: kind must be %q or %q", rule.Name, KindCommand, KindFileChange)
+		}
+		engine.rules = append(engine.rules, compiledRule{
+			Rule:     rule,
+			commands: compileCommandGlobs(rule.Commands, rule.Decision),
+			cwd:      compileGlobs(rule.Cwd),
+			paths:    compileGlobs(rule.Paths),
+			threads:  compileGlobs(rule.Threads),
+			clients:  compileGlobs(rule.Clients),
+		})
+	}
+	return engine, nil
+}
+
+// Evaluate returns the decision of the first matching rule.
+func (e *Engine) Evaluate(req Request) (Decision, bool) {
+	if e == nil {
+		return Decision{}, false
+	}
+	for _, rule := range e.rules {
+		if rule.matches(req) {
+			return Decision{Decision: rule.Decision, Rule: rule.Name, Reason: rule.Reason}, true
+		}
+	}
+	return Decision{}, false
+}
+
+func (r compiledRule) matches(req Request) bool {
+	if r.Kind != "" && r.Kind != req.Kind {
+		return false
+	}
+	if len(r.clients) > 0 && !matchAny(r.clients, req.ClientKey) {
+		return false
+	}
+	if len(r.threads) > 0 && !matchAny(r.threads, req.ThreadID) {
+		return false
+	}
+	if r.Decision == DecisionDecline {
+		return r.matchesDecline(req)
+	}
+
+	if len(r.cwd) > 0 {
+		cwd, ok := cleanPath(req.Cwd)
+		if !ok || !matchAny(r.cwd, cwd) {
+			return false
+		}
+	}
+	if len(r.commands) > 0 {
+		command := strings.TrimSpace(req.Command)
+		if command == "" || hasShellMeta(command) || !matchAll(r.commands, req.Commands) {
+			return false
+		}
+	}
+	if len(r.paths) > 0 {
+		paths := make([]string, 0, len(req.Paths))
+		for _, path := range req.Paths {
+			clean, ok := cleanPath(path)
+			if !ok {
+				return false
+			}
+			paths = append(paths, clean)
+		}
+		if !matchAll(r.paths, paths) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesDecline is matches for decline rules: any command or path, raw or
+// cleaned, may trigger it.
+func (r compiledRule) matchesDecline(req Request) bool {
+	if len(r.cwd) > 0 && !matchSome(r.cwd, withCleaned([]string{req.Cwd})) {
+		return false
+	}
+	if len(r.commands) > 0 {
+		commands := req.Commands
+		if req.Command != "" {
+			commands = append(slices.Clone(commands), req.Command)
+		}
+		if !matchSome(r.commands, commands) {
+			return false
+		}
+	}
+	if len(r.paths) > 0 && !matchSome(r.paths, withCleaned(req.Paths)) {
+		return false
+	}
+	return true
+}
+
+// cleanPath returns path cleaned, or false if it is relative or still
+// climbs out with `..`.
+func cleanPath(path string) (string, bool) {
+	path = strings.TrimSpace(path)
+	if !filepath.IsAbs(path) {
+		return "", false
+	}
+	path = filepath.Clean(path)
+	if slices.Contains(strings.Split(filepath.ToSlash(path), "/"), "..") {
+		return "", false
+	}
+	return path, true
+}
+
+func withCleaned(paths []string) []string {
+	out := slices.Clone(paths)
+	for _, path := range paths {
+		if path = strings.TrimSpace(path); path != "" {
+			out = append(out, filepath.Clean(path))
+		}
+	}
+	return out
+}
+
+func matchAny(patterns []*regexp.Regexp, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAll(patterns []*regexp.Regexp, values []string) bool {
+	if len(values) == 0 {
+		return false
+	}
+	for _, value := range values {
+		if !matchAny(patterns, strings.TrimSpace(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchSome(patterns []*regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if matchAny(patterns, strings.TrimSpace(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// shellMeta are the characters that let one command line run another.
+const shellMeta = ";&|$`<>()\n\r"
+
+func hasShellMeta(command string) bool {
+	return strings.ContainsAny(command, shellMeta)
+}
+
+func compileGlobs(globs []string) []*regexp.Regexp {
+	return compileGlobsWith(globs, ".*")
+}
+
+// compileCommandGlobs compiles command patterns. For accept rules `*` stops
+// at shell metacharacters, so it cannot swallow a second command.
+func compileCommandGlobs(globs []string, decision string) []*regexp.Regexp {
+	if decision == DecisionDecline {
+		return compileGlobs(globs)
+	}
+	return compileGlobsWith(globs, "[^"+regexp.QuoteMeta(shellMeta)+"]*")
+}
+
+func compileGlobsWith(globs []string, star string) []*regexp.Regexp {
+	out := make([]*regexp.Regexp, 0, len(globs))
+	for _, glob := range globs {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		parts := strings.Split(glob, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		out = append(out, regexp.MustCompile("^"+strings.Join(parts, star)+"$"))
+	}
+	return out
+}